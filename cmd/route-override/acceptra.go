@@ -0,0 +1,292 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ipv6ConfDir holds the per-interface IPv6 sysctls of the current netns
+var ipv6ConfDir = "/proc/sys/net/ipv6/conf"
+
+// AcceptRAConfig sets which parts of IPv6 router advertisements a container
+// interface accepts, so that RAs do not re-add the routes that were
+// overridden
+type AcceptRAConfig struct {
+	DefRtr        *bool `json:"defrtr,omitempty"`
+	RtrPref       *bool `json:"rtrpref,omitempty"`
+	PInfo         *bool `json:"pinfo,omitempty"`
+	RtInfoMaxPlen *int  `json:"rtinfomaxplen,omitempty"`
+}
+
+// validate checks the values of the settings
+func (a *AcceptRAConfig) validate() error {
+	if a.RtInfoMaxPlen != nil && (*a.RtInfoMaxPlen < 0 || *a.RtInfoMaxPlen > 128) {
+		return fmt.Errorf("invalid acceptra rtinfomaxplen %d: must be 0 to 128", *a.RtInfoMaxPlen)
+	}
+	return nil
+}
+
+// merge returns the settings with those of other on top
+func (a *AcceptRAConfig) merge(other *AcceptRAConfig) *AcceptRAConfig {
+	if a == nil {
+		return other
+	}
+	if other == nil {
+		return a
+	}
+	merged := *a
+	if other.DefRtr != nil {
+		merged.DefRtr = other.DefRtr
+	}
+	if other.RtrPref != nil {
+		merged.RtrPref = other.RtrPref
+	}
+	if other.PInfo != nil {
+		merged.PInfo = other.PInfo
+	}
+	if other.RtInfoMaxPlen != nil {
+		merged.RtInfoMaxPlen = other.RtInfoMaxPlen
+	}
+	return &merged
+}
+
+// sysctls returns the sysctl values of the settings, by sysctl name
+func (a *AcceptRAConfig) sysctls() map[string]string {
+	values := map[string]string{}
+	for name, value := range map[string]*bool{
+		"accept_ra_defrtr":   a.DefRtr,
+		"accept_ra_rtr_pref": a.RtrPref,
+		"accept_ra_pinfo":    a.PInfo,
+	} {
+		if value == nil {
+			continue
+		}
+		values[name] = "0"
+		if *value {
+			values[name] = "1"
+		}
+	}
+	if a.RtInfoMaxPlen != nil {
+		values["accept_ra_rt_info_max_plen"] = strconv.Itoa(*a.RtInfoMaxPlen)
+	}
+	return values
+}
+
+// acceptRASysctls returns the sysctl values to set on each container
+// interface. The top-level acceptra applies to all of them, with the
+// settings of the interfaces entry on top.
+func (conf *RouteOverrideConfig) acceptRASysctls(ifNames []string) map[string]map[string]string {
+	all := map[string]map[string]string{}
+	for _, name := range ifNames {
+		settings := conf.AcceptRA
+		if ifConf := conf.interfaceConfig(name); ifConf != nil {
+			settings = settings.merge(ifConf.AcceptRA)
+		}
+		if settings == nil {
+			continue
+		}
+		if values := settings.sysctls(); len(values) > 0 {
+			all[name] = values
+		}
+	}
+	return all
+}
+
+// sysctlPath returns the path of an IPv6 sysctl of the interface
+func sysctlPath(ifName, name string) string {
+	return filepath.Join(ipv6ConfDir, ifName, name)
+}
+
+func readSysctl(ifName, name string) (string, error) {
+	data, err := os.ReadFile(sysctlPath(ifName, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to read sysctl: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func writeSysctl(ifName, name, value string) error {
+	if err := os.WriteFile(sysctlPath(ifName, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write sysctl: %v", err)
+	}
+	return nil
+}
+
+// sysctlChanges describes the sysctl writes, as "set <path>=<value>" in a
+// stable order
+func sysctlChanges(values map[string]map[string]string) []string {
+	changes := []string{}
+	for dev, devValues := range values {
+		for name, value := range devValues {
+			changes = append(changes, fmt.Sprintf("set %s=%s", sysctlPath(dev, name), value))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// sortedNames returns the keys of the map in sorted order, so that the
+// sysctls are changed in a stable order
+func sortedNames(values map[string]map[string]string) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// acceptRAState records the sysctl values that ADD replaced, so that DEL
+// can restore them
+type acceptRAState struct {
+	path string
+
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+	// Previous holds the replaced values by interface and sysctl name
+	Previous map[string]map[string]string `json:"previous"`
+}
+
+// acceptRAStatePath returns the state file for the given
+// container/interface, in a directory per container like the journal
+func acceptRAStatePath(runDir, containerID, ifName string) string {
+	return filepath.Join(runDir, "acceptra", containerID, ifName+".json")
+}
+
+// newAcceptRAState creates an empty state, which is not written until a
+// sysctl is changed
+func newAcceptRAState(runDir, containerID, ifName string) *acceptRAState {
+	return &acceptRAState{
+		path:        acceptRAStatePath(runDir, containerID, ifName),
+		ContainerID: containerID,
+		IfName:      ifName,
+		Previous:    map[string]map[string]string{},
+	}
+}
+
+// loadAcceptRAState reads the state of the given container/interface, or
+// returns an empty state if there is none
+func loadAcceptRAState(runDir, containerID, ifName string) (*acceptRAState, error) {
+	s := newAcceptRAState(runDir, containerID, ifName)
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read %q: %v", s.path, err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", s.path, err)
+	}
+	return s, nil
+}
+
+// remove deletes the state once the values are restored
+func (s *acceptRAState) remove() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %q: %v", s.path, err)
+	}
+	os.Remove(filepath.Dir(s.path))
+	return nil
+}
+
+// applyAcceptRA sets the sysctls in the current netns. The values they
+// replace are recorded before they are changed; a repeated ADD keeps the
+// values recorded first. Interfaces without IPv6 are skipped.
+func applyAcceptRA(values map[string]map[string]string, runDir, containerID, ifName string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	state, err := loadAcceptRAState(runDir, containerID, ifName)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, dev := range sortedNames(values) {
+		if _, err := os.Stat(filepath.Join(ipv6ConfDir, dev)); err != nil {
+			continue
+		}
+		for name := range values[dev] {
+			if _, ok := state.Previous[dev][name]; ok {
+				continue
+			}
+			previous, err := readSysctl(dev, name)
+			if err != nil {
+				return err
+			}
+			if state.Previous[dev] == nil {
+				state.Previous[dev] = map[string]string{}
+			}
+			state.Previous[dev][name] = previous
+			changed = true
+		}
+	}
+	if changed {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to serialize %q: %v", state.path, err)
+		}
+		if err := writeFileAtomic(state.path, data); err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range sortedNames(values) {
+		if _, ok := state.Previous[dev]; !ok {
+			continue
+		}
+		for name, value := range values[dev] {
+			if err := writeSysctl(dev, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreAcceptRA writes back the values that ADD replaced, in the
+// current netns. Interfaces that are gone are skipped. A dry run only
+// reports the values.
+func restoreAcceptRA(runDir, containerID, ifName string, dryRun bool) error {
+	state, err := loadAcceptRAState(runDir, containerID, ifName)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		for _, change := range sysctlChanges(state.Previous) {
+			fmt.Fprintf(os.Stderr, "route-override: dry run: %s\n", change)
+		}
+		return nil
+	}
+	for _, dev := range sortedNames(state.Previous) {
+		if _, err := os.Stat(filepath.Join(ipv6ConfDir, dev)); err != nil {
+			continue
+		}
+		for name, value := range state.Previous[dev] {
+			if err := writeSysctl(dev, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return state.remove()
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override router advertisement sysctls", func() {
+	testConf := func(settings string) *RouteOverrideConfig {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			`+settings+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		return conf
+	}
+
+	It("applies the top-level settings with those of the interfaces on top", func() {
+		conf := testConf(`"acceptra": { "defrtr": false, "rtinfomaxplen": 0 },
+			"interfaces": {
+				"net*": { "acceptra": { "rtrpref": false, "pinfo": true } },
+				"net1": { "acceptra": { "defrtr": true } }
+			}`)
+		Expect(conf.acceptRASysctls([]string{"eth0", "net0", "net1"})).To(Equal(map[string]map[string]string{
+			"eth0": {"accept_ra_defrtr": "0", "accept_ra_rt_info_max_plen": "0"},
+			"net0": {"accept_ra_defrtr": "0", "accept_ra_rt_info_max_plen": "0", "accept_ra_rtr_pref": "0", "accept_ra_pinfo": "1"},
+			"net1": {"accept_ra_defrtr": "1", "accept_ra_rt_info_max_plen": "0"},
+		}))
+		Expect(testConf(`"flushgateway": true`).acceptRASysctls([]string{"net0"})).To(BeEmpty())
+	})
+
+	It("allows acceptra in interfaces with routes and operations", func() {
+		conf := testConf(`"routes": ["default via fd00::1"], "interfaces": { "net1": { "acceptra": { "defrtr": false } } }`)
+		Expect(conf.acceptRASysctls([]string{"net1"})).To(HaveKey("net1"))
+
+		for settings, expected := range map[string]string{
+			`"routes": [], "interfaces": { "net1": { "flushgateway": true, "acceptra": {} } }`: "interfaces cannot be combined with routes or operations",
+			`"acceptra": { "rtinfomaxplen": 129 }`:                                             "invalid acceptra rtinfomaxplen 129: must be 0 to 128",
+			`"interfaces": { "net1": { "acceptra": { "rtinfomaxplen": -1 } } }`:                `interfaces["net1"]: invalid acceptra rtinfomaxplen -1: must be 0 to 128`,
+		} {
+			_, err := parseConf([]byte(`{ "name": "test", "type": "route-override", "cniVersion": "0.3.1", `+settings+` }`), "")
+			Expect(err).To(MatchError(expected), settings)
+		}
+	})
+
+	Context("with sysctl files", func() {
+		var dir, savedConfDir string
+
+		readFile := func(path string) string {
+			data, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			return strings.TrimSpace(string(data))
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "route-override-acceptra")
+			Expect(err).NotTo(HaveOccurred())
+			savedConfDir = ipv6ConfDir
+			ipv6ConfDir = filepath.Join(dir, "conf")
+			Expect(os.MkdirAll(filepath.Join(ipv6ConfDir, "net1"), 0755)).To(Succeed())
+			for name, value := range map[string]string{"accept_ra_defrtr": "1\n", "accept_ra_pinfo": "1\n"} {
+				Expect(os.WriteFile(sysctlPath("net1", name), []byte(value), 0644)).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			ipv6ConfDir = savedConfDir
+			os.RemoveAll(dir)
+		})
+
+		It("records the previous values and restores them", func() {
+			runDir := filepath.Join(dir, "run")
+			values := map[string]map[string]string{
+				"net1": {"accept_ra_defrtr": "0"},
+				// no IPv6 on net2
+				"net2": {"accept_ra_defrtr": "0"},
+			}
+			Expect(applyAcceptRA(values, runDir, "dummy", "net1")).To(Succeed())
+			Expect(readFile(sysctlPath("net1", "accept_ra_defrtr"))).To(Equal("0"))
+
+			// a repeated ADD keeps the values recorded first
+			values["net1"]["accept_ra_pinfo"] = "0"
+			Expect(applyAcceptRA(values, runDir, "dummy", "net1")).To(Succeed())
+			state, err := loadAcceptRAState(runDir, "dummy", "net1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Previous).To(Equal(map[string]map[string]string{
+				"net1": {"accept_ra_defrtr": "1", "accept_ra_pinfo": "1"},
+			}))
+
+			// a dry run leaves the values and the state alone
+			Expect(restoreAcceptRA(runDir, "dummy", "net1", true)).To(Succeed())
+			Expect(readFile(sysctlPath("net1", "accept_ra_defrtr"))).To(Equal("0"))
+			Expect(acceptRAStatePath(runDir, "dummy", "net1")).To(BeAnExistingFile())
+
+			Expect(restoreAcceptRA(runDir, "dummy", "net1", false)).To(Succeed())
+			Expect(readFile(sysctlPath("net1", "accept_ra_defrtr"))).To(Equal("1"))
+			Expect(readFile(sysctlPath("net1", "accept_ra_pinfo"))).To(Equal("1"))
+			_, err = os.Stat(filepath.Join(runDir, "acceptra", "dummy"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			// nothing to restore
+			Expect(restoreAcceptRA(runDir, "dummy", "net1", false)).To(Succeed())
+		})
+	})
+
+	It("sets the sysctls on ADD and restores them on DEL", func() {
+		const IFNAME string = "dummy0"
+		originalNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer originalNS.Close()
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+		runDir, err := os.MkdirTemp("", "route-override-acceptra")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(runDir)
+
+		sysctl := func() string {
+			var value string
+			err := targetNS.Do(func(ns.NetNS) error {
+				var err error
+				value, err = readSysctl(IFNAME, "accept_ra_defrtr")
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return value
+		}
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sysctl()).To(Equal("1"))
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData: []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"cniVersion": "0.3.1",
+				"rundir": "` + runDir + `",
+				"flushgateway": true,
+				"acceptra": { "defrtr": false },
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [{ "name": "dummy0", "sandbox": "netns" }],
+					"ips": [{ "version": "6", "address": "fd00::2/64", "interface": 0 }]
+				}
+			}`),
+		}
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sysctl()).To(Equal("0"))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sysctl()).To(Equal("1"))
+	})
+})
@@ -0,0 +1,329 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+const (
+	// argsMergeReplace replaces the route lists of the configuration with
+	// the lists given in args
+	argsMergeReplace = "replace"
+	// argsMergeAppend adds the routes given in args after the configured ones
+	argsMergeAppend = "append"
+	// argsMergePrepend adds the routes given in args before the configured ones
+	argsMergePrepend = "prepend"
+)
+
+// ArgsAllowConfig restricts what the args of a pod may change
+type ArgsAllowConfig struct {
+	Fields   []string      `json:"fields,omitempty"`
+	Prefixes []types.IPNet `json:"prefixes,omitempty"`
+}
+
+// argsFields are the keys that args and runtimeConfig can set
+var argsFields = map[string]bool{
+	"flushroutes": true, "flushgateway": true, "delroutes": true, "addroutes": true,
+	"routes": true, "keeproutes": true, "rules": true, "skipcheck": true, "dryrun": true,
+}
+
+// fields returns the names of the keys that are set in args
+func (a *IPAMArgs) fields() []string {
+	fields := []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"flushroutes", a.FlushRoutes != nil},
+		{"flushgateway", a.FlushGateway != nil},
+		{"delroutes", a.DelRoutes != nil},
+		{"addroutes", a.AddRoutes != nil},
+		{"routes", a.Routes != nil},
+		{"keeproutes", a.KeepRoutes != nil},
+		{"rules", a.Rules != nil},
+		{"skipcheck", a.SkipCheck != nil},
+		{"dryrun", a.DryRun != nil},
+	} {
+		if f.set {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+// nullRoute returns an error for the first null entry of a route list
+func nullRoute(path string, entries []*RouteEntry) error {
+	for i, entry := range entries {
+		if entry == nil {
+			return fmt.Errorf("%s[%d]: missing route", path, i)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the overrides from source (args or
+// runtimeConfig) have an entry that is null
+func (a *IPAMArgs) validate(source string) error {
+	for _, l := range []struct {
+		key     string
+		entries []*RouteEntry
+	}{
+		{"delroutes", a.DelRoutes},
+		{"addroutes", a.AddRoutes},
+		{"routes", a.Routes},
+		{"keeproutes", a.KeepRoutes},
+	} {
+		if err := nullRoute(source+" "+l.key, l.entries); err != nil {
+			return err
+		}
+	}
+	for i, rule := range a.Rules {
+		if rule == nil {
+			return fmt.Errorf("%s rules[%d]: missing rule", source, i)
+		}
+	}
+	return nil
+}
+
+// containsPrefix returns true if the prefix covers all of dst
+func containsPrefix(prefix *net.IPNet, dst *net.IPNet) bool {
+	prefixOnes, prefixBits := prefix.Mask.Size()
+	dstOnes, dstBits := dst.Mask.Size()
+	return prefixBits == dstBits && prefixOnes <= dstOnes && prefix.Contains(dst.IP)
+}
+
+// allowed returns true if the destination lies within one of the prefixes
+func (allow *ArgsAllowConfig) allowed(dst *net.IPNet) bool {
+	for i := range allow.Prefixes {
+		if containsPrefix((*net.IPNet)(&allow.Prefixes[i]), dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if the overrides from source (args or
+// runtimeConfig) set a field, a route destination or a rule destination
+// that the allowlist does not permit
+func (allow *ArgsAllowConfig) check(source string, a *IPAMArgs) error {
+	permitted := map[string]bool{}
+	for _, field := range allow.Fields {
+		permitted[field] = true
+	}
+	for _, field := range a.fields() {
+		if !permitted[field] {
+			return fmt.Errorf("%s cannot set %s", source, field)
+		}
+	}
+
+	if allow.Prefixes == nil {
+		return nil
+	}
+	for field, entries := range map[string][]*RouteEntry{
+		"delroutes":  a.DelRoutes,
+		"addroutes":  a.AddRoutes,
+		"routes":     a.Routes,
+		"keeproutes": a.KeepRoutes,
+	} {
+		for _, entry := range entries {
+			if entry.template != "" {
+				return fmt.Errorf("%s %s: route templates cannot be checked against the allowed prefixes", source, field)
+			}
+			if !allow.allowed(&entry.Dst) {
+				return fmt.Errorf("%s %s: %s is outside of the allowed prefixes", source, field, entry.Dst.String())
+			}
+		}
+	}
+	// a rule without a destination selects all traffic
+	for _, rule := range a.Rules {
+		if rule.Dst == nil || !allow.allowed((*net.IPNet)(rule.Dst)) {
+			return fmt.Errorf("%s rules: %q is outside of the allowed prefixes", source, rule.String())
+		}
+	}
+	return nil
+}
+
+// routeKey identifies a route entry by destination and table
+func routeKey(entry *RouteEntry) string {
+	if entry.template != "" {
+		return entry.template
+	}
+	return fmt.Sprintf("%s %d", entry.Dst.String(), entry.table())
+}
+
+// mergeRoutes merges the routes given in args into the configured routes.
+// Of the routes given in args with the same destination and table, only the
+// first is used, and it replaces a configured route with the same
+// destination and table.
+func mergeRoutes(policy string, configured, args []*RouteEntry) []*RouteEntry {
+	seen := map[string]bool{}
+	fromArgs := []*RouteEntry{}
+	for _, entry := range args {
+		if !seen[routeKey(entry)] {
+			seen[routeKey(entry)] = true
+			fromArgs = append(fromArgs, entry)
+		}
+	}
+	if policy == argsMergeReplace {
+		return fromArgs
+	}
+
+	kept := []*RouteEntry{}
+	for _, entry := range configured {
+		if !seen[routeKey(entry)] {
+			kept = append(kept, entry)
+		}
+	}
+
+	if policy == argsMergePrepend {
+		return append(fromArgs, kept...)
+	}
+	return append(kept, fromArgs...)
+}
+
+// mergeRules merges the rules given in args into the configured rules like
+// mergeRoutes, with identical rules given only once
+func mergeRules(policy string, configured, args []*kernelRule) []*kernelRule {
+	seen := map[string]bool{}
+	fromArgs := []*kernelRule{}
+	for _, rule := range args {
+		if !seen[rule.String()] {
+			seen[rule.String()] = true
+			fromArgs = append(fromArgs, rule)
+		}
+	}
+	if policy == argsMergeReplace {
+		return fromArgs
+	}
+
+	kept := []*kernelRule{}
+	for _, rule := range configured {
+		if !seen[rule.String()] {
+			kept = append(kept, rule)
+		}
+	}
+
+	if policy == argsMergePrepend {
+		return append(fromArgs, kept...)
+	}
+	return append(kept, fromArgs...)
+}
+
+// checkLocked returns an error if the overrides set a locked field
+func (conf *RouteOverrideConfig) checkLocked(source string, a *IPAMArgs) error {
+	locked := map[string]bool{}
+	for _, field := range conf.Locked {
+		locked[field] = true
+	}
+	for _, field := range a.fields() {
+		if locked[field] {
+			return fmt.Errorf("%s cannot set locked field %s", source, field)
+		}
+	}
+	return nil
+}
+
+// override sets the configuration values given in a
+func (conf *RouteOverrideConfig) override(a *IPAMArgs) {
+	if a.FlushRoutes != nil {
+		conf.FlushRoutes = *a.FlushRoutes
+	}
+
+	if a.FlushGateway != nil {
+		conf.FlushGateway = *a.FlushGateway
+	}
+
+	if a.DelRoutes != nil {
+		conf.DelRoutes = mergeRoutes(conf.ArgsMerge, conf.DelRoutes, a.DelRoutes)
+	}
+
+	if a.AddRoutes != nil {
+		conf.AddRoutes = mergeRoutes(conf.ArgsMerge, conf.AddRoutes, a.AddRoutes)
+	}
+
+	if a.Routes != nil {
+		conf.Routes = mergeRoutes(conf.ArgsMerge, conf.Routes, a.Routes)
+	}
+
+	if a.KeepRoutes != nil {
+		conf.KeepRoutes = mergeRoutes(conf.ArgsMerge, conf.KeepRoutes, a.KeepRoutes)
+	}
+
+	if a.Rules != nil {
+		conf.Rules = mergeRules(conf.ArgsMerge, conf.Rules, a.Rules)
+	}
+
+	if a.SkipCheck != nil {
+		conf.SkipCheck = *a.SkipCheck
+	}
+
+	if a.DryRun != nil {
+		conf.DryRun = *a.DryRun
+	}
+}
+
+// applyArgs overrides the configuration with the values given in args and
+// then with the values given in runtimeConfig
+func (conf *RouteOverrideConfig) applyArgs() error {
+	switch conf.ArgsMerge {
+	case "":
+		conf.ArgsMerge = argsMergeReplace
+	case argsMergeReplace, argsMergeAppend, argsMergePrepend:
+	default:
+		return fmt.Errorf("invalid argsmerge %q: must be %q, %q or %q",
+			conf.ArgsMerge, argsMergeReplace, argsMergeAppend, argsMergePrepend)
+	}
+
+	for _, field := range conf.Locked {
+		if !argsFields[field] {
+			return fmt.Errorf("invalid locked field %q", field)
+		}
+	}
+
+	if conf.Args != nil && conf.Args.A != nil {
+		if err := conf.Args.A.validate("args"); err != nil {
+			return err
+		}
+		if conf.ArgsAllow != nil {
+			if err := conf.ArgsAllow.check("args", conf.Args.A); err != nil {
+				return err
+			}
+		}
+		if err := conf.checkLocked("args", conf.Args.A); err != nil {
+			return err
+		}
+		conf.override(conf.Args.A)
+	}
+
+	if conf.RuntimeConfig != nil && conf.RuntimeConfig.RouteOverride != nil {
+		if err := conf.RuntimeConfig.RouteOverride.validate("runtimeConfig"); err != nil {
+			return err
+		}
+		if conf.ArgsAllow != nil {
+			if err := conf.ArgsAllow.check("runtimeConfig", conf.RuntimeConfig.RouteOverride); err != nil {
+				return err
+			}
+		}
+		if err := conf.checkLocked("runtimeConfig", conf.RuntimeConfig.RouteOverride); err != nil {
+			return err
+		}
+		conf.override(conf.RuntimeConfig.RouteOverride)
+	}
+	return nil
+}
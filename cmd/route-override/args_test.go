@@ -0,0 +1,287 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testRouteStrings formats route entries for comparison
+func testRouteStrings(entries []*RouteEntry) []string {
+	routes := []string{}
+	for _, entry := range entries {
+		routes = append(routes, entry.String())
+	}
+	return routes
+}
+
+var _ = Describe("route-override args", func() {
+	testConf := func(merge, allow string) string {
+		return `{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"argsmerge": "` + merge + `",
+			` + allow + `
+			"addroutes": [
+				"10.10.0.0/16 via 10.1.0.1",
+				"10.20.0.0/16 via 10.1.0.1",
+				"10.20.0.0/16 via 10.1.0.1 table 100"
+			],
+			"args": {
+				"cni": {
+					"addroutes": [
+						"10.20.0.0/16 via 10.1.0.2",
+						"10.30.0.0/16 via 10.1.0.2",
+						"10.30.0.0/16 via 10.1.0.3"
+					]
+				}
+			}
+		}`
+	}
+
+	It("ignores args without cni", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"flushgateway": true,
+			"args": { "other": { "key": "value" } }
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.FlushGateway).To(BeTrue())
+	})
+
+	It("replaces the configured routes by default, deduplicated by destination and table", func() {
+		conf, err := parseConf([]byte(testConf("", "")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.ArgsMerge).To(Equal(argsMergeReplace))
+		Expect(testRouteStrings(conf.AddRoutes)).To(Equal([]string{
+			"10.20.0.0/16 via 10.1.0.2",
+			"10.30.0.0/16 via 10.1.0.2",
+		}))
+	})
+
+	It("appends and prepends routes deduplicated by destination and table", func() {
+		conf, err := parseConf([]byte(testConf("append", "")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testRouteStrings(conf.AddRoutes)).To(Equal([]string{
+			"10.10.0.0/16 via 10.1.0.1",
+			"10.20.0.0/16 via 10.1.0.1 table 100",
+			"10.20.0.0/16 via 10.1.0.2",
+			"10.30.0.0/16 via 10.1.0.2",
+		}))
+
+		conf, err = parseConf([]byte(testConf("prepend", "")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testRouteStrings(conf.AddRoutes)).To(Equal([]string{
+			"10.20.0.0/16 via 10.1.0.2",
+			"10.30.0.0/16 via 10.1.0.2",
+			"10.10.0.0/16 via 10.1.0.1",
+			"10.20.0.0/16 via 10.1.0.1 table 100",
+		}))
+
+		_, err = parseConf([]byte(testConf("merge", "")), "")
+		Expect(err).To(MatchError(`invalid argsmerge "merge": must be "replace", "append" or "prepend"`))
+	})
+
+	It("restricts args to the allowed fields and prefixes", func() {
+		conf, err := parseConf([]byte(testConf("append",
+			`"argsallow": { "fields": ["addroutes"], "prefixes": ["10.0.0.0/8"] },`)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(conf.AddRoutes)).To(Equal(4))
+
+		_, err = parseConf([]byte(testConf("append",
+			`"argsallow": { "fields": ["delroutes"] },`)), "")
+		Expect(err).To(MatchError("args cannot set addroutes"))
+
+		_, err = parseConf([]byte(testConf("append",
+			`"argsallow": { "fields": ["addroutes"], "prefixes": ["10.20.0.0/16"] },`)), "")
+		Expect(err).To(MatchError("args addroutes: 10.30.0.0/16 is outside of the allowed prefixes"))
+
+		// the default route is outside of any narrower prefix
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"argsallow": { "fields": ["addroutes"], "prefixes": ["10.0.0.0/8", "fd00::/8"] },
+			"args": { "cni": { "addroutes": ["0.0.0.0/0 via 10.1.0.1"] } }
+		}`), "")
+		Expect(err).To(MatchError("args addroutes: 0.0.0.0/0 is outside of the allowed prefixes"))
+	})
+
+	It("applies runtimeConfig after args", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"capabilities": { "routeOverride": true },
+			"flushroutes": true,
+			"flushgateway": true,
+			"addroutes": ["10.10.0.0/16 via 10.1.0.1"],
+			"args": { "cni": { "flushgateway": false, "addroutes": ["10.20.0.0/16 via 10.1.0.1"] } },
+			"runtimeConfig": {
+				"routeOverride": { "addroutes": ["10.30.0.0/16 via 10.1.0.1"], "delroutes": ["10.40.0.0/16"] }
+			}
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.FlushRoutes).To(BeTrue())
+		Expect(conf.FlushGateway).To(BeFalse())
+		Expect(testRouteStrings(conf.AddRoutes)).To(Equal([]string{"10.30.0.0/16 via 10.1.0.1"}))
+		Expect(testRouteStrings(conf.DelRoutes)).To(Equal([]string{"10.40.0.0/16"}))
+	})
+
+	It("restricts runtimeConfig to the allowed fields and prefixes", func() {
+		testRuntimeConf := func(routeOverride string) []byte {
+			return []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"cniVersion": "0.3.1",
+				"capabilities": { "routeOverride": true },
+				"argsallow": { "fields": ["addroutes", "rules"], "prefixes": ["10.0.0.0/8"] },
+				"runtimeConfig": { "routeOverride": ` + routeOverride + ` }
+			}`)
+		}
+
+		conf, err := parseConf(testRuntimeConf(`{ "addroutes": ["10.30.0.0/16 via 10.1.0.1"], "rules": ["to 10.30.0.0/16 table 100"] }`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testRouteStrings(conf.AddRoutes)).To(Equal([]string{"10.30.0.0/16 via 10.1.0.1"}))
+
+		_, err = parseConf(testRuntimeConf(`{ "addroutes": ["default via 10.1.0.1"] }`), "")
+		Expect(err).To(MatchError("runtimeConfig addroutes: 0.0.0.0/0 is outside of the allowed prefixes"))
+
+		_, err = parseConf(testRuntimeConf(`{ "flushgateway": true }`), "")
+		Expect(err).To(MatchError("runtimeConfig cannot set flushgateway"))
+
+		// a rule without a destination selects all traffic
+		_, err = parseConf(testRuntimeConf(`{ "rules": ["from 10.1.0.0/16 table 100"] }`), "")
+		Expect(err).To(MatchError(`runtimeConfig rules: "from 10.1.0.0/16 lookup 100" is outside of the allowed prefixes`))
+	})
+
+	It("adds the rules of the configuration, args and runtimeConfig after the routes", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"argsmerge": "append",
+			"addroutes": ["10.10.0.0/16 via 10.1.0.1 table 100"],
+			"rules": ["from 10.1.0.0/16 table 100 priority 100"],
+			"args": { "cni": { "rules": ["to 10.20.0.0/16 table 100", "to 10.20.0.0/16 table 100"] } },
+			"runtimeConfig": { "routeOverride": { "rules": ["from 10.1.0.0/16 table 100 priority 100", "fwmark 0x10 table 100"] } },
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{ "name": "net1", "sandbox": "netns" }],
+				"ips": [{ "version": "4", "address": "10.1.0.2/24", "gateway": "10.1.0.1", "interface": 0 }]
+			}
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, []string{"net1"}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"replace 10.10.0.0/16 via 10.1.0.1 dev net1 table 100",
+			"add rule from all to 10.20.0.0/16 lookup 100",
+			"add rule from 10.1.0.0/16 lookup 100 priority 100",
+			"add rule from all fwmark 0x10 lookup 100",
+		}))
+	})
+
+	It("rejects null routes", func() {
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": ["10.10.0.0/16 via 10.1.0.1", null]
+		}`), "")
+		Expect(err).To(MatchError("addroutes[1]: missing route"))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"argsmerge": "append",
+			"delroutes": ["10.10.0.0/16"],
+			"runtimeConfig": { "routeOverride": { "delroutes": ["10.20.0.0/16", null] } }
+		}`), "")
+		Expect(err).To(MatchError("runtimeConfig delroutes[1]: missing route"))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"args": { "cni": { "addroutes": [null] } }
+		}`), "")
+		Expect(err).To(MatchError("args addroutes[0]: missing route"))
+	})
+
+	It("rejects null rules", func() {
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"rules": ["from 10.1.0.0/16 table 100", null]
+		}`), "")
+		Expect(err).To(MatchError("rules[1]: missing rule"))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"argsallow": { "fields": ["rules"], "prefixes": ["10.0.0.0/8"] },
+			"args": { "cni": { "rules": [null] } }
+		}`), "")
+		Expect(err).To(MatchError("args rules[0]: missing rule"))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"runtimeConfig": { "routeOverride": { "rules": [null] } }
+		}`), "")
+		Expect(err).To(MatchError("runtimeConfig rules[0]: missing rule"))
+	})
+
+	It("rejects overrides of locked fields", func() {
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"flushgateway": true,
+			"locked": ["flushgateway"],
+			"runtimeConfig": { "routeOverride": { "flushgateway": false } }
+		}`), "")
+		Expect(err).To(MatchError("runtimeConfig cannot set locked field flushgateway"))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"locked": ["addroutes"],
+			"args": { "cni": { "addroutes": ["10.20.0.0/16 via 10.1.0.1"] } }
+		}`), "")
+		Expect(err).To(MatchError("args cannot set locked field addroutes"))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"locked": ["mode"]
+		}`), "")
+		Expect(err).To(MatchError(`invalid locked field "mode"`))
+	})
+})
@@ -0,0 +1,272 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/vishvananda/netlink"
+)
+
+const netnsRunDir = "/var/run/netns"
+
+// debugNetnsPath resolves a netns given by name (as in "ip netns") or path
+func debugNetnsPath(netns string) string {
+	if strings.Contains(netns, "/") {
+		return netns
+	}
+	return filepath.Join(netnsRunDir, netns)
+}
+
+// synthesizePrevResult builds a prevResult from the current addresses and
+// gateway routes of the interface, as an IPAM plugin would have returned
+// them
+func synthesizePrevResult(netnsPath, ifName string) (*current.Result, error) {
+	res := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find link %q: %v", ifName, err)
+		}
+		res.Interfaces = []*current.Interface{{
+			Name:    ifName,
+			Mac:     link.Attrs().HardwareAddr.String(),
+			Sandbox: netnsPath,
+		}}
+
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			addrs, err := netlink.AddrList(link, family)
+			if err != nil {
+				return fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+			}
+			routes, err := netlink.RouteList(link, family)
+			if err != nil {
+				return fmt.Errorf("failed to list routes of %q: %v", ifName, err)
+			}
+			var gw net.IP
+			for _, route := range routes {
+				if route.Gw == nil {
+					continue
+				}
+				dst := route.Dst
+				if dst == nil {
+					dst = defaultDst(family)
+					if gw == nil {
+						gw = route.Gw
+					}
+				}
+				res.Routes = append(res.Routes, &types.Route{Dst: *dst, GW: route.Gw})
+			}
+			for _, addr := range addrs {
+				if addr.Scope != int(netlink.SCOPE_UNIVERSE) {
+					continue
+				}
+				res.IPs = append(res.IPs, &current.IPConfig{
+					Interface: current.Int(0),
+					Address:   *addr.IPNet,
+					Gateway:   gw,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// debugConf adds a synthesized prevResult to the configuration, unless it
+// already has one
+func debugConf(data []byte, netnsPath, ifName string) ([]byte, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if _, ok := raw["prevResult"]; ok {
+		return data, nil
+	}
+
+	res, err := synthesizePrevResult(netnsPath, ifName)
+	if err != nil {
+		return nil, err
+	}
+	cniVersion, _ := raw["cniVersion"].(string)
+	prevResult, err := res.GetAsVersion(cniVersion)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert prevResult to version %q: %v", cniVersion, err)
+	}
+	raw["prevResult"] = prevResult
+	return json.Marshal(raw)
+}
+
+// debugRoutes dumps the routes of all tables of the netns but the local
+// table, in "ip route" syntax
+func debugRoutes(netnsPath string) ([]string, error) {
+	lines := []string{}
+	err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		return withKernel(func(k *kernel) error {
+			routes, err := k.dumpRoutes()
+			if err != nil {
+				return err
+			}
+			for _, route := range routes {
+				lines = append(lines, route.String())
+			}
+			return nil
+		})
+	})
+	return lines, err
+}
+
+// printSideBySide prints the routing tables before and after in two
+// columns, one row per route, with removed and added routes marked
+func printSideBySide(w io.Writer, before, after []string) {
+	inBefore := map[string]bool{}
+	inAfter := map[string]bool{}
+	rows := []string{}
+	for _, route := range before {
+		inBefore[route] = true
+		rows = append(rows, route)
+	}
+	for _, route := range after {
+		inAfter[route] = true
+		if !inBefore[route] {
+			rows = append(rows, route)
+		}
+	}
+	sort.Strings(rows)
+
+	width := len("Before")
+	for _, route := range before {
+		if len(route) > width {
+			width = len(route)
+		}
+	}
+
+	fmt.Fprintf(w, "  %-*s | %s\n", width, "Before", "After")
+	fmt.Fprintf(w, "  %s-+-%s\n", strings.Repeat("-", width), strings.Repeat("-", width))
+	for _, route := range rows {
+		left, right, mark := "", "", " "
+		if inBefore[route] {
+			left = route
+		}
+		if inAfter[route] {
+			right = route
+		}
+		if left == "" {
+			mark = "+"
+		} else if right == "" {
+			mark = "-"
+		}
+		fmt.Fprintf(w, "%s %-*s | %s\n", mark, width, left, right)
+	}
+}
+
+// runDebug runs ADD, CHECK or DEL against a netns as a runtime would, and
+// prints the routing table before and after
+func runDebug(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("debug", flag.ContinueOnError)
+	confPath := flags.String("config", "", "plugin configuration (JSON); prevResult is synthesized if missing")
+	netns := flags.String("netns", "", "netns name (as in \"ip netns\") or path")
+	ifName := flags.String("ifname", "eth0", "container interface name (CNI_IFNAME)")
+	containerID := flags.String("containerid", "route-override-debug", "container ID (CNI_CONTAINERID)")
+	cniArgs := flags.String("args", "", "CNI_ARGS, e.g. \"K8S_POD_NAMESPACE=ns;K8S_POD_NAME=pod\"")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: route-override debug [flags] add|check|del\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *confPath == "" || *netns == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("--config, --netns and a command are required")
+	}
+
+	var cmd func(*skel.CmdArgs) error
+	switch strings.ToLower(flags.Arg(0)) {
+	case "add":
+		// ADD prints its result to stdout like a plugin does
+		cmd = func(args *skel.CmdArgs) error {
+			result, err := addResult(args)
+			if err != nil {
+				return err
+			}
+			return result.PrintTo(stdout)
+		}
+	case "check":
+		cmd = cmdCheck
+	case "del":
+		cmd = cmdDel
+	default:
+		return fmt.Errorf("unknown command %q: must be add, check or del", flags.Arg(0))
+	}
+
+	netnsPath := debugNetnsPath(*netns)
+	data, err := os.ReadFile(*confPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+	data, err = debugConf(data, netnsPath, *ifName)
+	if err != nil {
+		return err
+	}
+
+	before, err := debugRoutes(netnsPath)
+	if err != nil {
+		return err
+	}
+
+	command := strings.ToUpper(flags.Arg(0))
+	fmt.Fprintf(stdout, "%s:\n", command)
+	cmdErr := cmd(&skel.CmdArgs{
+		ContainerID: *containerID,
+		Netns:       netnsPath,
+		IfName:      *ifName,
+		Args:        *cniArgs,
+		StdinData:   data,
+	})
+	if cmdErr != nil {
+		fmt.Fprintf(stdout, "%s failed: %v\n", command, cmdErr)
+	} else {
+		if command == "ADD" {
+			fmt.Fprintln(stdout)
+		}
+		fmt.Fprintf(stdout, "%s succeeded\n", command)
+	}
+
+	after, err := debugRoutes(netnsPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Routing table:")
+	printSideBySide(stdout, before, after)
+
+	return cmdErr
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override debug", func() {
+	It("resolves netns names and paths", func() {
+		Expect(debugNetnsPath("pod1")).To(Equal("/var/run/netns/pod1"))
+		Expect(debugNetnsPath("/proc/1234/ns/net")).To(Equal("/proc/1234/ns/net"))
+	})
+
+	It("prints routing tables side by side", func() {
+		out := &bytes.Buffer{}
+		printSideBySide(out,
+			[]string{"default via 10.0.0.1 dev net1", "10.0.0.0/24 dev net1"},
+			[]string{"10.0.0.0/24 dev net1", "20.0.0.0/24 via 10.0.0.254 dev net1"})
+		Expect(out.String()).To(Equal(`  Before                        | After
+  ------------------------------+------------------------------
+  10.0.0.0/24 dev net1          | 10.0.0.0/24 dev net1
++                               | 20.0.0.0/24 via 10.0.0.254 dev net1
+- default via 10.0.0.1 dev net1 | 
+`))
+	})
+
+	It("synthesizes prevResult from the interface addresses", func() {
+		const IFNAME string = "dummy0"
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err = netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.LinkSetUp(link)
+			Expect(err).NotTo(HaveOccurred())
+
+			// addr 10.0.0.2/24
+			err = testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))
+			Expect(err).NotTo(HaveOccurred())
+
+			// add default gateway into IFNAME
+			err = testAddRoute(link,
+				net.IPv4(0, 0, 0, 0), net.CIDRMask(0, 0),
+				net.IPv4(10, 0, 0, 1))
+			Expect(err).NotTo(HaveOccurred())
+
+			//"dst": "30.0.0.0/24"
+			err = testAddRoute(link,
+				net.IPv4(30, 0, 0, 0), net.CIDRMask(24, 32),
+				net.IPv4(10, 0, 0, 254))
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := debugConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.4.0"
+		}`), targetNS.Path(), IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+
+		conf, err := parseConf(data, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.PrevResult).NotTo(BeNil())
+		Expect(len(conf.PrevResult.Interfaces)).To(Equal(1))
+		Expect(conf.PrevResult.Interfaces[0].Name).To(Equal(IFNAME))
+		Expect(conf.PrevResult.Interfaces[0].Sandbox).To(Equal(targetNS.Path()))
+		Expect(len(conf.PrevResult.IPs)).To(Equal(1))
+		Expect(conf.PrevResult.IPs[0].Address.String()).To(Equal("10.0.0.2/24"))
+		Expect(conf.PrevResult.IPs[0].Gateway.String()).To(Equal("10.0.0.1"))
+		Expect(len(conf.PrevResult.Routes)).To(Equal(2))
+		Expect(conf.PrevResult.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(conf.PrevResult.Routes[1].Dst.String()).To(Equal("30.0.0.0/24"))
+		Expect(conf.PrevResult.Routes[1].GW.String()).To(Equal("10.0.0.254"))
+	})
+
+	It("prints the ADD result to its output", func() {
+		const IFNAME string = "dummy0"
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+		dir, err := os.MkdirTemp("", "route-override-debug")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err = netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			return testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		confPath := filepath.Join(dir, "conf.json")
+		Expect(os.WriteFile(confPath, []byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.4.0",
+			"rundir": "`+dir+`",
+			"addroutes": ["20.0.0.0/24 via 10.0.0.254"]
+		}`), 0600)).To(Succeed())
+
+		out := &bytes.Buffer{}
+		Expect(runDebug([]string{"--config", confPath, "--netns", targetNS.Path(), "--ifname", IFNAME, "add"}, out)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`"cniVersion": "0.4.0"`))
+		Expect(out.String()).To(ContainSubstring(`"dst": "20.0.0.0/24"`))
+		Expect(out.String()).To(ContainSubstring("ADD succeeded"))
+	})
+})
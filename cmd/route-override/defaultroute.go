@@ -0,0 +1,191 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultRouteConfig moves the default route to this attachment
+type DefaultRouteConfig struct {
+	GW       string        `json:"gw,omitempty"`
+	Metric   int           `json:"metric,omitempty"`
+	Preserve []types.IPNet `json:"preserve,omitempty"`
+}
+
+// validate checks the gateway and the metric
+func (d *DefaultRouteConfig) validate() error {
+	if d.GW != "" && parseRouteAddr(d.GW) == nil {
+		return fmt.Errorf("invalid defaultroute gw %q", d.GW)
+	}
+	if d.Metric < 0 {
+		return fmt.Errorf("invalid defaultroute metric %d: must not be negative", d.Metric)
+	}
+	return nil
+}
+
+// gateways returns the new default gateways: the configured one, or the
+// gateways of the addresses in the result, one per family
+func (d *DefaultRouteConfig) gateways(res *current.Result) ([]net.IP, error) {
+	if d.GW != "" {
+		return []net.IP{parseRouteAddr(d.GW)}, nil
+	}
+	gws := []net.IP{}
+	families := map[int]bool{}
+	for _, ip := range res.IPs {
+		if ip.Gateway == nil || ip.Gateway.IsUnspecified() {
+			continue
+		}
+		family := ruleFamily(ip.Gateway)
+		if !families[family] {
+			families[family] = true
+			gws = append(gws, normalizeIP(ip.Gateway))
+		}
+	}
+	if len(gws) == 0 {
+		return nil, fmt.Errorf("defaultroute: no gw given and no gateway in prevResult")
+	}
+	return gws, nil
+}
+
+// normalizeIP returns IPv4 addresses in 4-byte form
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// planDefaultRoute computes the handoff of the default route of a family
+// to the gateway on this attachment. The preserved prefixes are routed via
+// the old default gateway first, then the new default route replaces the
+// old one with the same metric, which the kernel does atomically, and only
+// then are the remaining old default routes deleted. The replace records
+// the old default route, so that rolling back an interrupted handoff
+// reinstalls it.
+func planDefaultRoute(d *DefaultRouteConfig, dev string, gw net.IP, routes []*kernelRoute) ([]*routeOperation, error) {
+	family := ruleFamily(gw)
+	newRoute := &kernelRoute{
+		Dev:      dev,
+		Dst:      types.IPNet(*defaultDst(family)),
+		Gw:       gw,
+		Priority: d.Metric,
+		Table:    syscall.RT_TABLE_MAIN,
+		Scope:    netlink.SCOPE_UNIVERSE,
+	}
+
+	// the old default route with the lowest metric carries the traffic
+	var old *kernelRoute
+	olds := []*kernelRoute{}
+	for _, route := range routes {
+		if route.Table != syscall.RT_TABLE_MAIN || !route.isDefault() ||
+			ruleFamily(route.Dst.IP) != family || route.String() == newRoute.String() {
+			continue
+		}
+		olds = append(olds, route)
+		if old == nil || route.Priority < old.Priority {
+			old = route
+		}
+	}
+	if d.Metric == 0 && old != nil {
+		newRoute.Priority = old.Priority
+	}
+
+	ops := []*routeOperation{}
+	table := newRouteTable(routes)
+	for i := range d.Preserve {
+		prefix := (*net.IPNet)(&d.Preserve[i])
+		if ruleFamily(prefix.IP) != family {
+			continue
+		}
+		if old != nil {
+			ops = append(ops, &routeOperation{Action: opReplace, Route: &kernelRoute{
+				Dev:   old.Dev,
+				Dst:   types.IPNet(*prefix),
+				Gw:    old.Gw,
+				Table: syscall.RT_TABLE_MAIN,
+				Scope: netlink.SCOPE_UNIVERSE,
+			}})
+			continue
+		}
+		// on a repeated ADD, the old default route is already gone
+		preserved := false
+		for _, route := range table.byDst[dstKey(prefix)] {
+			if route.Table == syscall.RT_TABLE_MAIN {
+				preserved = true
+			}
+		}
+		if !preserved {
+			return nil, fmt.Errorf("defaultroute: cannot preserve %s: no default route to preserve it through", prefix)
+		}
+	}
+
+	replaced := ""
+	if len(olds) > 0 || !hasRoute(routes, newRoute) {
+		ops = append(ops, &routeOperation{Action: opReplace, Route: newRoute})
+		replaced = desiredKey(newRoute)
+	}
+	for _, route := range olds {
+		if desiredKey(route) != replaced {
+			ops = append(ops, &routeOperation{Action: opDelete, Route: route})
+		}
+	}
+	return ops, nil
+}
+
+// hasRoute returns true if the route is in the routing table
+func hasRoute(routes []*kernelRoute, route *kernelRoute) bool {
+	for _, r := range routes {
+		if r.Table == route.Table && r.String() == route.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// planDefaultRoutes hands the default route of each family over to this
+// attachment, and reports the new default routes in the result
+func planDefaultRoutes(conf *RouteOverrideConfig, res *current.Result, dev string, routes []*kernelRoute) ([]*routeOperation, error) {
+	gws, err := conf.DefaultRoute.gateways(res)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []*routeOperation{}
+	for _, gw := range gws {
+		familyOps, err := planDefaultRoute(conf.DefaultRoute, dev, gw, routes)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, familyOps...)
+
+		dst := *defaultDst(ruleFamily(gw))
+		kept := []*types.Route{}
+		for _, route := range res.Routes {
+			if dstKey(&route.Dst) != dstKey(&dst) {
+				kept = append(kept, route)
+			}
+		}
+		res.Routes = append(kept, &types.Route{Dst: dst, GW: gw})
+	}
+	return ops, nil
+}
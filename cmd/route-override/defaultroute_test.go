@@ -0,0 +1,274 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override default route handoff", func() {
+	const IFNAME string = "dummy0"
+	const PRIMARY string = "dummy1"
+
+	defaultRouteConf := func(runDir string) []byte {
+		return []byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"rundir": "` + runDir + `",
+			"defaultroute": {
+				"preserve": ["10.96.0.0/12", "10.128.0.0/14"]
+			},
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [
+				{
+					"name": "dummy0",
+					"sandbox":"netns"
+				}],
+				"ips": [
+				{
+					"version": "4",
+					"address": "10.0.0.2/24",
+					"gateway": "10.0.0.1",
+					"interface": 0
+				}]
+			}
+		}`)
+	}
+
+	It("routes the preserved prefixes via the old gateway before replacing the default", func() {
+		conf, err := parseConf(defaultRouteConf("/run"), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		primary := testJournalRoute("0.0.0.0/0", "192.168.0.1")
+		primary.Dev = PRIMARY
+		fallback := testJournalRoute("0.0.0.0/0", "192.168.0.254")
+		fallback.Dev = PRIMARY
+		fallback.Priority = 100
+		routes := []*kernelRoute{primary, fallback}
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"replace 10.96.0.0/12 via 192.168.0.1 dev dummy1",
+			"replace 10.128.0.0/14 via 192.168.0.1 dev dummy1",
+			"replace default via 10.0.0.1 dev dummy0",
+			"delete default via 192.168.0.254 dev dummy1 metric 100",
+		}))
+		Expect(len(plan.Result.Routes)).To(Equal(1))
+		Expect(plan.Result.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(plan.Result.Routes[0].GW.String()).To(Equal("10.0.0.1"))
+
+		// a repeated ADD finds nothing left to do
+		again, err := planRoutes(conf, []string{"dummy0"}, simulateOperations(routes, plan.Operations))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again.Operations).To(BeEmpty())
+
+		// the preserved prefixes cannot be routed without an old gateway
+		_, err = planRoutes(conf, []string{"dummy0"}, []*kernelRoute{})
+		Expect(err).To(MatchError("defaultroute: cannot preserve 10.96.0.0/12: no default route to preserve it through"))
+	})
+
+	It("validates the configuration", func() {
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"flushgateway": true,
+			"defaultroute": {}
+		}`), "")
+		Expect(err).To(MatchError("defaultroute cannot be combined with flushgateway, routes or operations"))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"defaultroute": {"gw": "10.0.0"}
+		}`), "")
+		Expect(err).To(MatchError(`invalid defaultroute gw "10.0.0"`))
+	})
+
+	// setupNetns creates the netns of a pod whose default route is on the
+	// primary interface
+	setupNetns := func() (ns.NetNS, ns.NetNS, string) {
+		originalNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		runDir, err := os.MkdirTemp("", "route-override-defaultroute")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, name := range []string{IFNAME, PRIMARY} {
+				err := netlink.LinkAdd(&netlink.Dummy{
+					LinkAttrs: netlink.LinkAttrs{
+						Name: name,
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(link)).To(Succeed())
+			}
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))).To(Succeed())
+			link, err = netlink.LinkByName(PRIMARY)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testAddAddr(link, net.IPv4(192, 168, 0, 2), net.CIDRMask(24, 32))).To(Succeed())
+			Expect(testAddRoute(link, net.IPv4(0, 0, 0, 0), net.CIDRMask(0, 0), net.IPv4(192, 168, 0, 1))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return originalNS, targetNS, runDir
+	}
+
+	// gatewayRoutes lists the routes via a gateway in the netns
+	gatewayRoutes := func(targetNS ns.NetNS) []string {
+		gwRoutes := []string{}
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			for _, route := range routes {
+				if route.Gw == nil {
+					continue
+				}
+				dst := "default"
+				if route.Dst != nil {
+					dst = route.Dst.String()
+				}
+				gwRoutes = append(gwRoutes, fmt.Sprintf("%s via %s metric %d", dst, route.Gw, route.Priority))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		sort.Strings(gwRoutes)
+		return gwRoutes
+	}
+
+	It("hands the default route over in the netns", func() {
+		originalNS, targetNS, runDir := setupNetns()
+		defer originalNS.Close()
+		defer targetNS.Close()
+		defer os.RemoveAll(runDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   defaultRouteConf(runDir),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(gatewayRoutes(targetNS)).To(Equal([]string{
+			"10.128.0.0/14 via 192.168.0.1 metric 0",
+			"10.96.0.0/12 via 192.168.0.1 metric 0",
+			"default via 10.0.0.1 metric 0",
+		}))
+	})
+
+	It("restores the old default route when DEL rolls back an interrupted handoff", func() {
+		originalNS, targetNS, runDir := setupNetns()
+		defer originalNS.Close()
+		defer targetNS.Close()
+		defer os.RemoveAll(runDir)
+
+		conf, err := parseConf(defaultRouteConf(runDir), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		// ADD was killed after replacing the default route, before deleting
+		// the fallback default route
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(PRIMARY)
+			Expect(err).NotTo(HaveOccurred())
+			_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+			Expect(netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: net.IPv4(192, 168, 0, 254), Priority: 100})).To(Succeed())
+
+			return withKernel(func(k *kernel) error {
+				routes, err := k.dumpRoutes()
+				Expect(err).NotTo(HaveOccurred())
+				plan, err := planRoutes(conf, []string{IFNAME}, routes)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(testPlanOperations(plan)).To(Equal([]string{
+					"replace 10.96.0.0/12 via 192.168.0.1 dev dummy1",
+					"replace 10.128.0.0/14 via 192.168.0.1 dev dummy1",
+					"replace default via 10.0.0.1 dev dummy0",
+					"delete default via 192.168.0.254 dev dummy1 metric 100",
+				}))
+				for _, op := range plan.Operations[:3] {
+					Expect(k.apply(op)).To(Succeed())
+					op.Done = true
+				}
+				j := newJournal(runDir, "dummy", IFNAME)
+				j.Operations = plan.Operations
+				return j.save()
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gatewayRoutes(targetNS)).To(Equal([]string{
+			"10.128.0.0/14 via 192.168.0.1 metric 0",
+			"10.96.0.0/12 via 192.168.0.1 metric 0",
+			"default via 10.0.0.1 metric 0",
+			"default via 192.168.0.254 metric 100",
+		}))
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   defaultRouteConf(runDir),
+		}
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(gatewayRoutes(targetNS)).To(Equal([]string{
+			"default via 192.168.0.1 metric 0",
+			"default via 192.168.0.254 metric 100",
+		}))
+	})
+})
@@ -0,0 +1,155 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/vishvananda/netlink"
+)
+
+// desiredKernelRoutes converts the desired routes to kernel routes, with
+// the defaults that the kernel fills in, so that they compare equal to the
+// routes that ADD installed
+func desiredKernelRoutes(conf *RouteOverrideConfig, ifNames []string) []*kernelRoute {
+	routes := []*kernelRoute{}
+	for _, entry := range conf.Routes {
+		op := addRoute(ifNames[0], entry, modeReplace)
+		op.Route.Table = entry.table()
+		routes = append(routes, op.kernelRoute())
+	}
+	return routes
+}
+
+// desiredKey identifies a route the way the kernel does on replace
+func desiredKey(route *kernelRoute) string {
+	return fmt.Sprintf("%d %s %d", route.Table, dstKey((*net.IPNet)(&route.Dst)), route.Priority)
+}
+
+// sameRoute returns true if the kernel route is the desired route. The
+// protocol is only compared if the desired route sets one.
+func sameRoute(desired, route *kernelRoute) bool {
+	if desired.Protocol != 0 && desired.Protocol != route.Protocol {
+		return false
+	}
+	return desired.String() == route.String() && desired.Scope == route.Scope
+}
+
+// isLinkRoute returns true for routes that the kernel maintains for the
+// addresses of an interface, which the desired state never removes
+func isLinkRoute(route *kernelRoute) bool {
+	if route.Scope == netlink.SCOPE_LINK || route.Dst.IP.IsLinkLocalUnicast() {
+		return true
+	}
+	return route.Gw == nil && route.Protocol == syscall.RTPROT_KERNEL
+}
+
+// planDesiredRoutes computes the operations that turn the routes of the
+// interfaces into the desired routes: missing routes are added, differing
+// routes are replaced and other routes are deleted, except link routes.
+// Routes are added before others are deleted, so that the interfaces keep
+// a route while it is being changed.
+func planDesiredRoutes(conf *RouteOverrideConfig, ifNames []string, routes []*kernelRoute) []*routeOperation {
+	desired := desiredKernelRoutes(conf, ifNames)
+
+	devs := map[string]bool{}
+	for _, name := range ifNames {
+		devs[name] = true
+	}
+	tables := map[int]bool{syscall.RT_TABLE_MAIN: true}
+	for _, route := range desired {
+		devs[route.Dev] = true
+		tables[route.Table] = true
+	}
+
+	existing := map[string][]*kernelRoute{}
+	owned := []*kernelRoute{}
+	for _, route := range routes {
+		if !devs[route.Dev] || !tables[route.Table] || isLinkRoute(route) {
+			continue
+		}
+		existing[desiredKey(route)] = append(existing[desiredKey(route)], route)
+		owned = append(owned, route)
+	}
+
+	ops := []*routeOperation{}
+	keep := map[*kernelRoute]bool{}
+	for _, want := range desired {
+		found := false
+		for _, route := range existing[desiredKey(want)] {
+			if sameRoute(want, route) {
+				keep[route] = true
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+		action := opReplace
+		if conf.Mode == modeAdd && len(existing[desiredKey(want)]) == 0 {
+			action = opAdd
+		}
+		ops = append(ops, &routeOperation{Action: action, Route: want})
+	}
+
+	for _, route := range owned {
+		if keep[route] {
+			continue
+		}
+		// a replaced route is gone once the desired route is installed
+		replaced := false
+		for _, op := range ops {
+			if op.Action == opReplace && desiredKey(op.Route) == desiredKey(route) {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			ops = append(ops, &routeOperation{Action: opDelete, Route: route})
+		}
+	}
+	return ops
+}
+
+// desiredResult returns the desired routes of the main table, as they are
+// reported in the CNI result
+func desiredResult(conf *RouteOverrideConfig) []*types.Route {
+	routes := []*types.Route{}
+	for _, entry := range conf.Routes {
+		if entry.table() == syscall.RT_TABLE_MAIN {
+			routes = append(routes, entry.cniRoute())
+		}
+	}
+	return routes
+}
+
+// planOwnedRoutes computes the operations that remove the desired routes
+// installed by ADD, leaving any other route alone
+func planOwnedRoutes(conf *RouteOverrideConfig, ifNames []string, routes []*kernelRoute) []*routeOperation {
+	table := newRouteTable(routes)
+	ops := []*routeOperation{}
+	for _, want := range desiredKernelRoutes(conf, ifNames) {
+		for _, route := range table.dstRoutes((*net.IPNet)(&want.Dst), []string{want.Dev}) {
+			if desiredKey(route) == desiredKey(want) && sameRoute(want, route) {
+				ops = append(ops, &routeOperation{Action: opDelete, Route: route})
+			}
+		}
+	}
+	return uniqueOperations(ops)
+}
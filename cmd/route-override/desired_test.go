@@ -0,0 +1,353 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override desired routes", func() {
+	const IFNAME string = "dummy0"
+
+	desiredConf := func(runDir string) []byte {
+		return []byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"rundir": "` + runDir + `",
+			"routes": [
+				"default via 10.0.0.254",
+				"20.0.0.0/24 via 10.0.0.1",
+				"40.0.0.0/24 via 10.0.0.1 table 200"
+			],
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [
+				{
+					"name": "dummy0",
+					"sandbox":"netns"
+				}],
+				"ips": [
+				{
+					"version": "4",
+					"address": "10.0.0.2/24",
+					"gateway": "10.0.0.1",
+					"interface": 0
+				}],
+				"routes": [
+				{
+					"dst": "0.0.0.0/0"
+				},
+				{
+					"dst": "30.0.0.0/24"
+				}]
+			}
+		}`)
+	}
+
+	It("plans the difference to the desired routes", func() {
+		conf, err := parseConf(desiredConf("/run"), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		linkRoute := testJournalRoute("10.0.0.0/24", "")
+		linkRoute.Scope = netlink.SCOPE_LINK
+		otherDev := testJournalRoute("50.0.0.0/24", "10.1.0.1")
+		otherDev.Dev = "eth0"
+		routes := []*kernelRoute{
+			linkRoute,
+			otherDev,
+			testJournalRoute("0.0.0.0/0", "10.0.0.1"),
+			testJournalRoute("20.0.0.0/24", "10.0.0.1"),
+			testJournalRoute("30.0.0.0/24", "10.0.0.1"),
+		}
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"replace default via 10.0.0.254 dev dummy0",
+			"replace 40.0.0.0/24 via 10.0.0.1 dev dummy0 table 200",
+			"delete 30.0.0.0/24 via 10.0.0.1 dev dummy0",
+		}))
+
+		Expect(len(plan.Result.Routes)).To(Equal(2))
+		Expect(plan.Result.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(plan.Result.Routes[0].GW.String()).To(Equal("10.0.0.254"))
+		Expect(plan.Result.Routes[1].Dst.String()).To(Equal("20.0.0.0/24"))
+
+		// DEL removes only the desired routes
+		ops := planOwnedRoutes(conf, []string{"dummy0"}, simulateOperations(routes, plan.Operations))
+		Expect(testPlanOperations(&routePlan{Operations: ops})).To(Equal([]string{
+			"delete default via 10.0.0.254 dev dummy0",
+			"delete 20.0.0.0/24 via 10.0.0.1 dev dummy0",
+			"delete 40.0.0.0/24 via 10.0.0.1 dev dummy0 table 200",
+		}))
+	})
+
+	It("gives IPv6 routes without a metric the kernel's default metric", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"routes": [
+				"default via fd00::1",
+				"fd01::/64 via fd00::1"
+			],
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{ "name": "dummy0", "sandbox": "netns" }],
+				"ips": [{ "version": "6", "address": "fd00::2/64", "interface": 0 }]
+			}
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		route := func(dst string) *kernelRoute {
+			_, ipnet, _ := net.ParseCIDR(dst)
+			return &kernelRoute{
+				Dev:      "dummy0",
+				Dst:      types.IPNet(*ipnet),
+				Gw:       net.ParseIP("fd00::1"),
+				Table:    syscall.RT_TABLE_MAIN,
+				Priority: ipv6DefaultMetric,
+			}
+		}
+
+		// the installed default route is neither replaced nor deleted
+		routes := []*kernelRoute{route("::/0")}
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"replace fd01::/64 via fd00::1 dev dummy0 metric 1024",
+		}))
+
+		// DEL finds both routes
+		ops := planOwnedRoutes(conf, []string{"dummy0"}, simulateOperations(routes, plan.Operations))
+		Expect(testPlanOperations(&routePlan{Operations: ops})).To(Equal([]string{
+			"delete default via fd00::1 dev dummy0 metric 1024",
+			"delete fd01::/64 via fd00::1 dev dummy0 metric 1024",
+		}))
+	})
+
+	It("cannot be combined with other route keys", func() {
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"flushroutes": true,
+			"routes": []
+		}`), "")
+		Expect(err).To(MatchError(ContainSubstring("routes cannot be combined with flushroutes")))
+	})
+
+	It("converges on ADD, reports differences on CHECK and cleans up on DEL", func() {
+		originalNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer originalNS.Close()
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+		runDir, err := os.MkdirTemp("", "route-override-desired")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(runDir)
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			Expect(testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))).To(Succeed())
+			Expect(testAddRoute(link, net.IPv4(0, 0, 0, 0), net.CIDRMask(0, 0), net.IPv4(10, 0, 0, 1))).To(Succeed())
+			Expect(testAddRoute(link, net.IPv4(30, 0, 0, 0), net.CIDRMask(24, 32), net.IPv4(10, 0, 0, 1))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   desiredConf(runDir),
+		}
+
+		routes := func() []string {
+			lines := []string{}
+			err := targetNS.Do(func(ns.NetNS) error {
+				return withKernel(func(k *kernel) error {
+					routes, err := k.dumpRoutes()
+					for _, route := range routes {
+						if route.Dst.IP.To4() != nil {
+							lines = append(lines, route.String())
+						}
+					}
+					return err
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return lines
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes()).To(ConsistOf(
+				"default via 10.0.0.254 dev dummy0",
+				"10.0.0.0/24 dev dummy0 src 10.0.0.2",
+				"20.0.0.0/24 via 10.0.0.1 dev dummy0",
+				"40.0.0.0/24 via 10.0.0.1 dev dummy0 table 200",
+			))
+
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(Succeed())
+
+			// a route added behind the plugin's back is reported by CHECK
+			err = targetNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName(IFNAME)
+				if err != nil {
+					return err
+				}
+				return testAddRoute(link, net.IPv4(30, 0, 0, 0), net.CIDRMask(24, 32), net.IPv4(10, 0, 0, 1))
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(MatchError("route-override: routes differ from the desired state: delete 30.0.0.0/24 via 10.0.0.1 dev dummy0"))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			Expect(routes()).To(ConsistOf(
+				"10.0.0.0/24 dev dummy0 src 10.0.0.2",
+				"30.0.0.0/24 via 10.0.0.1 dev dummy0",
+			))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("keeps IPv6 routes without a metric on ADD and removes them on DEL", func() {
+		originalNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer originalNS.Close()
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+		runDir, err := os.MkdirTemp("", "route-override-desired")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(runDir)
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			Expect(testAddAddr(link, net.ParseIP("fd00::2"), net.CIDRMask(64, 128))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData: []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"cniVersion": "0.3.1",
+				"rundir": "` + runDir + `",
+				"routes": [
+					"default via fd00::1",
+					"fd01::/64 via fd00::1"
+				],
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [{ "name": "dummy0", "sandbox": "netns" }],
+					"ips": [{ "version": "6", "address": "fd00::2/64", "interface": 0 }]
+				}
+			}`),
+		}
+
+		routes := func() []string {
+			lines := []string{}
+			err := targetNS.Do(func(ns.NetNS) error {
+				return withKernel(func(k *kernel) error {
+					routes, err := k.dumpRoutes()
+					for _, route := range routes {
+						if route.Gw != nil {
+							lines = append(lines, route.String())
+						}
+					}
+					return err
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return lines
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes()).To(ConsistOf(
+				"default via fd00::1 dev dummy0 metric 1024",
+				"fd01::/64 via fd00::1 dev dummy0 metric 1024",
+			))
+
+			Expect(testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})).To(Succeed())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			Expect(routes()).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,217 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// ifaceLookup finds interfaces in the container netns
+type ifaceLookup interface {
+	// hasLink returns true if the netns has a link with the given name
+	hasLink(name string) bool
+	// addrLink returns the name of the link with the address, if any
+	addrLink(ip net.IP) string
+}
+
+// sandboxIfNames returns the sandbox interface names in the result
+func sandboxIfNames(res *current.Result) []string {
+	names := []string{}
+	for _, netif := range res.Interfaces {
+		if netif.Sandbox != "" {
+			names = append(names, netif.Name)
+		}
+	}
+	return names
+}
+
+// containerIfNames returns the interfaces whose routes are changed. These
+// are the sandbox interfaces of the result or, if it lists none, CNI_IFNAME
+// or else the interface that has the addresses of the result. Routes
+// without a device are added on the first one.
+func containerIfNames(res *current.Result, ifName string, lookup ifaceLookup) ([]string, error) {
+	if res != nil {
+		if names := sandboxIfNames(res); len(names) > 0 {
+			return names, nil
+		}
+	}
+	if ifName != "" && lookup.hasLink(ifName) {
+		return []string{ifName}, nil
+	}
+	if res != nil {
+		for _, ip := range res.IPs {
+			if name := lookup.addrLink(ip.Address.IP); name != "" {
+				return []string{name}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to find the container interface: no sandbox interface in prevResult, no link %q and no link with the prevResult addresses", ifName)
+}
+
+// routeLookup finds interfaces in a routing table snapshot, for planning
+// without access to the netns
+type routeLookup []*kernelRoute
+
+func (routes routeLookup) hasLink(name string) bool {
+	for _, route := range routes {
+		if route.Dev == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addrLink finds the address as preferred source of a route, like the
+// prefix routes the kernel adds for the addresses of an interface
+func (routes routeLookup) addrLink(ip net.IP) string {
+	for _, route := range routes {
+		if route.Src != nil && route.Src.Equal(ip) {
+			return route.Dev
+		}
+	}
+	return ""
+}
+
+// InterfaceConfig overrides the top-level route settings for the container
+// interfaces matching its key
+type InterfaceConfig struct {
+	FlushRoutes  *bool         `json:"flushroutes,omitempty"`
+	FlushGateway *bool         `json:"flushgateway,omitempty"`
+	DelRoutes    []*RouteEntry `json:"delroutes,omitempty"`
+	AddRoutes    []*RouteEntry `json:"addroutes,omitempty"`
+	KeepRoutes   []*RouteEntry `json:"keeproutes,omitempty"`
+
+	AcceptRA *AcceptRAConfig `json:"acceptra,omitempty"`
+}
+
+// hasRoutes returns true if the entry sets any route settings, which only
+// apply to the flush, delete and add sequence
+func (ifConf *InterfaceConfig) hasRoutes() bool {
+	return ifConf.FlushRoutes != nil || ifConf.FlushGateway != nil ||
+		ifConf.DelRoutes != nil || ifConf.AddRoutes != nil || ifConf.KeepRoutes != nil
+}
+
+// interfaceRoutes are the effective route settings of a container interface
+type interfaceRoutes struct {
+	Name         string
+	FlushRoutes  bool
+	FlushGateway bool
+	DelRoutes    []*RouteEntry
+	AddRoutes    []*RouteEntry
+	KeepRoutes   []*RouteEntry
+}
+
+// interfaceConfig returns the entry of the interfaces map for the given
+// interface: the entry with its name, or else the first glob, in sorted
+// order, that matches it
+func (conf *RouteOverrideConfig) interfaceConfig(name string) *InterfaceConfig {
+	if ifConf, ok := conf.Interfaces[name]; ok {
+		return ifConf
+	}
+	keys := make([]string, 0, len(conf.Interfaces))
+	for key := range conf.Interfaces {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if ok, _ := filepath.Match(key, name); ok {
+			return conf.Interfaces[key]
+		}
+	}
+	return nil
+}
+
+// interfaceRoutes returns the route settings of each container interface.
+// The top-level settings are the defaults, except that the top-level
+// addroutes are only added on the first interface.
+func (conf *RouteOverrideConfig) interfaceRoutes(ifNames []string) []*interfaceRoutes {
+	all := []*interfaceRoutes{}
+	for i, name := range ifNames {
+		ifRoutes := &interfaceRoutes{
+			Name:         name,
+			FlushRoutes:  conf.FlushRoutes,
+			FlushGateway: conf.FlushGateway,
+			DelRoutes:    conf.DelRoutes,
+			KeepRoutes:   conf.KeepRoutes,
+		}
+		if i == 0 {
+			ifRoutes.AddRoutes = conf.AddRoutes
+		}
+
+		if ifConf := conf.interfaceConfig(name); ifConf != nil {
+			if ifConf.FlushRoutes != nil {
+				ifRoutes.FlushRoutes = *ifConf.FlushRoutes
+			}
+			if ifConf.FlushGateway != nil {
+				ifRoutes.FlushGateway = *ifConf.FlushGateway
+			}
+			if ifConf.DelRoutes != nil {
+				ifRoutes.DelRoutes = ifConf.DelRoutes
+			}
+			if ifConf.AddRoutes != nil {
+				ifRoutes.AddRoutes = ifConf.AddRoutes
+			}
+			if ifConf.KeepRoutes != nil {
+				ifRoutes.KeepRoutes = ifConf.KeepRoutes
+			}
+		}
+		all = append(all, ifRoutes)
+	}
+	return all
+}
+
+// keeps returns true if the kernel route matches one of the keeproutes
+func (ifRoutes *interfaceRoutes) keeps(route *kernelRoute) bool {
+	for _, keep := range ifRoutes.KeepRoutes {
+		if keep.Dev != "" && keep.Dev != route.Dev {
+			continue
+		}
+		if dstKey(&keep.Dst) == dstKey((*net.IPNet)(&route.Dst)) && keep.matchesKernel(route) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepsResult returns true if the result route matches one of the
+// keeproutes
+func (ifRoutes *interfaceRoutes) keepsResult(route *types.Route, gw net.IP) bool {
+	for _, keep := range ifRoutes.KeepRoutes {
+		if keep.matchesResult(route, gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipInterface returns the container interface of an address of the result,
+// the first one if the address refers to no container interface
+func ipInterface(res *current.Result, ip *current.IPConfig, ifNames []string) string {
+	if ip.Interface != nil && *ip.Interface >= 0 && *ip.Interface < len(res.Interfaces) {
+		name := res.Interfaces[*ip.Interface].Name
+		for _, ifName := range ifNames {
+			if ifName == name {
+				return name
+			}
+		}
+	}
+	return ifNames[0]
+}
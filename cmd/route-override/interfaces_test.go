@@ -0,0 +1,226 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override container interfaces", func() {
+	const IFNAME string = "dummy0"
+
+	It("selects the sandbox interfaces, CNI_IFNAME or the owner of the addresses", func() {
+		prefixRoute := testJournalRoute("10.0.0.0/24", "")
+		prefixRoute.Dev = "net1"
+		prefixRoute.Src = net.ParseIP("10.0.0.2").To4()
+		lookup := routeLookup{prefixRoute, testJournalRoute("0.0.0.0/0", "10.0.0.1")}
+
+		_, address, _ := net.ParseCIDR("10.0.0.2/24")
+		address.IP = net.ParseIP("10.0.0.2").To4()
+		res := &current.Result{
+			Interfaces: []*current.Interface{{Name: "veth0"}},
+			IPs:        []*current.IPConfig{{Address: *address}},
+		}
+
+		// host interfaces are not candidates
+		ifNames, err := containerIfNames(res, "dummy0", lookup)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ifNames).To(Equal([]string{"dummy0"}))
+
+		ifNames, err = containerIfNames(res, "net2", lookup)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ifNames).To(Equal([]string{"net1"}))
+
+		res.Interfaces = append(res.Interfaces,
+			&current.Interface{Name: "net3", Sandbox: "netns"},
+			&current.Interface{Name: "net4", Sandbox: "netns"})
+		ifNames, err = containerIfNames(res, "dummy0", lookup)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ifNames).To(Equal([]string{"net3", "net4"}))
+
+		_, err = containerIfNames(&current.Result{}, "net2", lookup)
+		Expect(err).To(MatchError(`failed to find the container interface: no sandbox interface in prevResult, no link "net2" and no link with the prevResult addresses`))
+	})
+
+	It("plans each interface with its own settings", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"flushgateway": true,
+			"addroutes": ["40.0.0.0/24 via 10.0.0.254"],
+			"keeproutes": ["30.0.0.0/24"],
+			"interfaces": {
+				"net*": {
+					"flushroutes": true,
+					"addroutes": ["50.0.0.0/24 via 10.1.0.254"]
+				},
+				"net2": {
+					"flushroutes": true,
+					"flushgateway": false,
+					"keeproutes": []
+				}
+			},
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [
+					{"name": "dummy0", "sandbox": "netns"},
+					{"name": "net1", "sandbox": "netns"},
+					{"name": "net2", "sandbox": "netns"}
+				],
+				"ips": [
+					{"version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0},
+					{"version": "4", "address": "10.2.0.2/24", "gateway": "10.2.0.1", "interface": 2}
+				],
+				"routes": [
+					{"dst": "0.0.0.0/0"},
+					{"dst": "30.0.0.0/24"}
+				]
+			}
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		route := func(dev, dst, gw string) *kernelRoute {
+			r := testJournalRoute(dst, gw)
+			r.Dev = dev
+			return r
+		}
+		routes := []*kernelRoute{
+			route("dummy0", "0.0.0.0/0", "10.0.0.1"),
+			route("dummy0", "30.0.0.0/24", "10.0.0.1"),
+			route("net1", "0.0.0.0/0", "10.1.0.1"),
+			route("net1", "30.0.0.0/24", "10.1.0.1"),
+			route("net1", "60.0.0.0/24", "10.1.0.1"),
+			route("net2", "0.0.0.0/0", "10.2.0.1"),
+			route("net2", "30.0.0.0/24", "10.2.0.1"),
+		}
+
+		plan, err := planRoutes(conf, []string{"dummy0", "net1", "net2"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"delete default via 10.0.0.1 dev dummy0",
+			"delete default via 10.1.0.1 dev net1",
+			"delete 60.0.0.0/24 via 10.1.0.1 dev net1",
+			"delete default via 10.2.0.1 dev net2",
+			"delete 30.0.0.0/24 via 10.2.0.1 dev net2",
+			"replace 40.0.0.0/24 via 10.0.0.254 dev dummy0",
+			"replace 50.0.0.0/24 via 10.1.0.254 dev net1",
+		}))
+
+		Expect(plan.Result.IPs[0].Gateway.String()).To(Equal("0.0.0.0"))
+		Expect(plan.Result.IPs[1].Gateway.String()).To(Equal("10.2.0.1"))
+		dsts := []string{}
+		for _, r := range plan.Result.Routes {
+			dsts = append(dsts, r.Dst.String())
+		}
+		Expect(dsts).To(Equal([]string{"40.0.0.0/24", "50.0.0.0/24"}))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"interfaces": {"net[": {}}
+		}`), "")
+		Expect(err).To(MatchError(`interfaces["net["]: invalid glob: syntax error in pattern`))
+	})
+
+	It("adds routes on CNI_IFNAME when prevResult has no interfaces", func() {
+		originalNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer originalNS.Close()
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+		runDir, err := os.MkdirTemp("", "route-override-interfaces")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(runDir)
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			Expect(testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))).To(Succeed())
+			Expect(testAddRoute(link, net.IPv4(0, 0, 0, 0), net.CIDRMask(0, 0), net.IPv4(10, 0, 0, 1))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData: []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"cniVersion": "0.3.1",
+				"rundir": "` + runDir + `",
+				"flushgateway": true,
+				"addroutes": [{"dst": "20.0.0.0/24", "gw": "10.0.0.254"}],
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"ips": [
+					{
+						"version": "4",
+						"address": "10.0.0.2/24",
+						"gateway": "10.0.0.1"
+					}]
+				}
+			}`),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testHasRoute(routes, nil)).To(BeFalse())
+			_, dst, _ := net.ParseCIDR("20.0.0.0/24")
+			Expect(testHasRoute(routes, dst)).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,224 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// journal records the route operations of an ADD before they are applied,
+// and which of them have completed. If the plugin is killed in the middle
+// of an ADD, the next ADD, CHECK or DEL for the same container and
+// interface finds the incomplete journal and finishes or rolls back the
+// operations.
+type journal struct {
+	path string
+
+	ContainerID string            `json:"containerID"`
+	IfName      string            `json:"ifname"`
+	Operations  []*routeOperation `json:"operations"`
+}
+
+// journalPath returns the journal file for the given container/interface.
+// Each container has its own directory, since both the container ID and the
+// interface name may contain dashes.
+func journalPath(runDir, containerID, ifName string) string {
+	return filepath.Join(runDir, "journal", containerID, ifName+".json")
+}
+
+// newJournal creates an empty journal, which is not written until save()
+func newJournal(runDir, containerID, ifName string) *journal {
+	return &journal{
+		path:        journalPath(runDir, containerID, ifName),
+		ContainerID: containerID,
+		IfName:      ifName,
+	}
+}
+
+// loadJournal reads the journal of the given container/interface. It
+// returns nil if there is no journal, i.e. the last ADD completed.
+func loadJournal(runDir, containerID, ifName string) (*journal, error) {
+	path := journalPath(runDir, containerID, ifName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read journal %q: %v", path, err)
+	}
+
+	j := &journal{path: path}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("failed to parse journal %q: %v", path, err)
+	}
+	return j, nil
+}
+
+// writeFileAtomic writes the file through a temporary file, so that a
+// crash never leaves a partially written file behind
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory of %q: %v", path, err)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write %q: %v", tmp, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %q: %v", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %q: %v", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %q: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write %q: %v", path, err)
+	}
+	return nil
+}
+
+// save writes the journal atomically
+func (j *journal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("failed to serialize journal: %v", err)
+	}
+	if err := writeFileAtomic(j.path, data); err != nil {
+		return fmt.Errorf("journal: %v", err)
+	}
+	return nil
+}
+
+// remove deletes the journal once all operations are settled, and the
+// directory of the container once it has no journal left
+func (j *journal) remove() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove journal %q: %v", j.path, err)
+	}
+	// other interfaces of the container may still have a journal
+	os.Remove(filepath.Dir(j.path))
+	return nil
+}
+
+// pending returns the number of operations not yet completed
+func (j *journal) pending() int {
+	n := 0
+	for _, op := range j.Operations {
+		if !op.Done {
+			n++
+		}
+	}
+	return n
+}
+
+// apply executes the pending operations in order, recording each one in
+// the journal as it completes. Failed operations are recorded as skipped
+// and reported through onError; if it returns an error, apply stops and
+// leaves the journal incomplete. A rule add that finds the rule in place is
+// skipped too. The journal is removed when every operation is done.
+func (j *journal) apply(k *kernel, onError func(op *routeOperation, err error) error) error {
+	if err := j.save(); err != nil {
+		return err
+	}
+
+	for _, op := range j.Operations {
+		if op.Done {
+			continue
+		}
+		err := k.apply(op)
+		if err == syscall.EEXIST && op.Rule != nil && op.Action == opAdd {
+			err = nil
+			op.Skipped = true
+		} else {
+			op.Skipped = err != nil
+		}
+		if err != nil {
+			// a rollback must not revert the failed operation
+			if err := j.save(); err != nil {
+				return err
+			}
+			if err := onError(op, err); err != nil {
+				return err
+			}
+		}
+		op.Done = true
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+
+	return j.remove()
+}
+
+// finish completes the operations of an interrupted ADD. Routes which an
+// interrupted operation may already have installed are not an error.
+func (j *journal) finish(k *kernel) error {
+	return j.apply(k, func(op *routeOperation, err error) error {
+		if op.Action == opAdd && err == syscall.EEXIST {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "route-override: failed to finish journaled operation %v: %v\n", op, err)
+		return nil
+	})
+}
+
+// rollback reverts the completed operations of an interrupted ADD in
+// reverse order and removes the journal. The first pending operation is
+// reverted as well, since the plugin may have been killed after applying
+// it but before recording it. Skipped operations are left alone, and
+// routes that a replace overwrote are reinstalled.
+func (j *journal) rollback(k *kernel) error {
+	for _, op := range j.rollbackOperations() {
+		if err := k.revert(op); err != nil {
+			fmt.Fprintf(os.Stderr, "route-override: failed to roll back journaled operation %v: %v\n", op, err)
+		}
+		op.Done = false
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+
+	return j.remove()
+}
+
+// rollbackOperations returns the operations that rollback reverts, in the
+// order it reverts them
+func (j *journal) rollbackOperations() []*routeOperation {
+	last := len(j.Operations) - 1
+	for i, op := range j.Operations {
+		if !op.Done {
+			last = i
+			break
+		}
+	}
+
+	ops := []*routeOperation{}
+	for i := last; i >= 0; i-- {
+		if !j.Operations[i].Skipped {
+			ops = append(ops, j.Operations[i])
+		}
+	}
+	return ops
+}
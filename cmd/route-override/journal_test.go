@@ -0,0 +1,447 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func testJournalRoute(dst string, gw string) *kernelRoute {
+	_, ipnet, _ := net.ParseCIDR(dst)
+	return &kernelRoute{
+		Dev:   "dummy0",
+		Dst:   types.IPNet(*ipnet),
+		Gw:    net.ParseIP(gw).To4(),
+		Table: syscall.RT_TABLE_MAIN,
+	}
+}
+
+var _ = Describe("route-override journal", func() {
+	const IFNAME string = "dummy0"
+	var originalNS ns.NetNS
+	var targetNS ns.NetNS
+	var runDir string
+
+	BeforeEach(func() {
+		var err error
+		runDir, err = os.MkdirTemp("", "route-override-journal")
+		Expect(err).NotTo(HaveOccurred())
+
+		originalNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		targetNS, err = testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err = netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			err = netlink.LinkSetUp(link)
+			Expect(err).NotTo(HaveOccurred())
+
+			// addr 10.0.0.2/24
+			err = testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(originalNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(runDir)).To(Succeed())
+	})
+
+	testConf := func() []byte {
+		return []byte(fmt.Sprintf(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"rundir": %q,
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [
+				{
+					"name": "dummy0", "sandbox":"netns"
+				}],
+				"ips": [
+				{
+					"version": "4",
+					"address": "10.0.0.2/24",
+					"gateway": "10.0.0.1",
+					"interface": 0
+				}]
+			}
+		}`, runDir))
+	}
+
+	It("saves and loads the journal", func() {
+		j, err := loadJournal(runDir, "dummy", IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(BeNil())
+
+		j = newJournal(runDir, "dummy", IFNAME)
+		j.Operations = []*routeOperation{
+			{Action: opDelete, Route: testJournalRoute("30.0.0.0/24", "10.0.0.1"), Done: true},
+			{Action: opReplace, Route: testJournalRoute("20.0.0.0/24", "10.0.0.254")},
+		}
+		Expect(j.save()).To(Succeed())
+
+		loaded, err := loadJournal(runDir, "dummy", IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded.pending()).To(Equal(1))
+		Expect(loaded.Operations[0].String()).To(Equal("delete 30.0.0.0/24 via 10.0.0.1 dev dummy0"))
+		Expect(loaded.Operations[1].String()).To(Equal("replace 20.0.0.0/24 via 10.0.0.254 dev dummy0"))
+
+		Expect(loaded.remove()).To(Succeed())
+		j, err = loadJournal(runDir, "dummy", IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(BeNil())
+	})
+
+	It("finishes an interrupted ADD on the next ADD", func() {
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			//"dst": "30.0.0.0/24"
+			err = testAddRoute(link,
+				net.IPv4(30, 0, 0, 0), net.CIDRMask(24, 32),
+				net.IPv4(10, 0, 0, 1))
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the previous ADD was killed before deleting 30.0.0.0/24
+		j := newJournal(runDir, "dummy", IFNAME)
+		j.Operations = []*routeOperation{
+			{Action: opDelete, Route: testJournalRoute("30.0.0.0/24", "10.0.0.1")},
+		}
+		Expect(j.save()).To(Succeed())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   testConf(),
+		}
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			routes, _ := netlink.RouteList(link, netlink.FAMILY_V4)
+			_, route1, _ := net.ParseCIDR("30.0.0.0/24")
+			Expect(testHasRoute(routes, route1)).To(Equal(false))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		j, err = loadJournal(runDir, "dummy", IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(BeNil())
+	})
+
+	It("rolls back an interrupted ADD on DEL", func() {
+		// the previous ADD deleted 30.0.0.0/24, then was killed while
+		// adding 20.0.0.0/24
+		j := newJournal(runDir, "dummy", IFNAME)
+		j.Operations = []*routeOperation{
+			{Action: opDelete, Route: testJournalRoute("30.0.0.0/24", "10.0.0.1"), Done: true},
+			{Action: opReplace, Route: testJournalRoute("20.0.0.0/24", "10.0.0.254")},
+		}
+		Expect(j.save()).To(Succeed())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   testConf(),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			routes, _ := netlink.RouteList(link, netlink.FAMILY_V4)
+			_, route1, _ := net.ParseCIDR("30.0.0.0/24")
+			Expect(testHasRoute(routes, route1)).To(Equal(true))
+			_, route2, _ := net.ParseCIDR("20.0.0.0/24")
+			Expect(testHasRoute(routes, route2)).To(Equal(false))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		j, err = loadJournal(runDir, "dummy", IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(BeNil())
+	})
+
+	It("leaves an interrupted ADD alone on a dry run DEL", func() {
+		j := newJournal(runDir, "dummy", IFNAME)
+		j.Operations = []*routeOperation{
+			{Action: opReplace, Route: testJournalRoute("20.0.0.0/24", "10.0.0.254"), Done: true},
+		}
+		Expect(j.save()).To(Succeed())
+
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			return testAddRoute(link,
+				net.IPv4(20, 0, 0, 0), net.CIDRMask(24, 32),
+				net.IPv4(10, 0, 0, 254))
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(strings.Replace(string(testConf()), `"rundir"`, `"dryrun": true, "rundir"`, 1)),
+		}
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			routes, _ := netlink.RouteList(link, netlink.FAMILY_V4)
+			_, route, _ := net.ParseCIDR("20.0.0.0/24")
+			Expect(testHasRoute(routes, route)).To(Equal(true))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		j, err = loadJournal(runDir, "dummy", IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).NotTo(BeNil())
+	})
+
+	It("reinstalls the route that a replace overwrote on rollback", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": ["default via 10.0.0.254"],
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{ "name": "dummy0", "sandbox": "netns" }],
+				"ips": [{ "version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0 }]
+			}
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		// the previous ADD replaced the default route, then was killed
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			err = testAddRoute(link,
+				net.IPv4(0, 0, 0, 0), net.CIDRMask(0, 32),
+				net.IPv4(10, 0, 0, 1))
+			Expect(err).NotTo(HaveOccurred())
+
+			return withKernel(func(k *kernel) error {
+				routes, err := k.dumpRoutes()
+				Expect(err).NotTo(HaveOccurred())
+				plan, err := planRoutes(conf, []string{IFNAME}, routes)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(testPlanOperations(plan)).To(Equal([]string{"replace default via 10.0.0.254 dev dummy0"}))
+				Expect(plan.Operations[0].Replaced.String()).To(Equal("default via 10.0.0.1 dev dummy0"))
+
+				Expect(k.apply(plan.Operations[0])).To(Succeed())
+				plan.Operations[0].Done = true
+				j := newJournal(runDir, "dummy", IFNAME)
+				j.Operations = plan.Operations
+				return j.save()
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   testConf(),
+		}
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			gws := []string{}
+			for _, route := range routes {
+				if route.Dst == nil {
+					gws = append(gws, route.Gw.String())
+				}
+			}
+			Expect(gws).To(Equal([]string{"10.0.0.1"}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = os.Stat(filepath.Join(runDir, "journal", "dummy"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("leaves the operations that failed or changed nothing alone on rollback", func() {
+		rule, err := parseRuleEntry("from 10.0.0.0/24 table 100 priority 100")
+		Expect(err).NotTo(HaveOccurred())
+
+		// the previous ADD found the rule and the route in place and failed
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testAddRoute(link, net.IPv4(20, 0, 0, 0), net.CIDRMask(24, 32), net.IPv4(10, 0, 0, 1))).To(Succeed())
+			Expect(netlink.RuleAdd(rule.netlinkRule())).To(Succeed())
+
+			return withKernel(func(k *kernel) error {
+				j := newJournal(runDir, "dummy", IFNAME)
+				j.Operations = []*routeOperation{
+					{Action: opAdd, Rule: rule},
+					{Action: opAdd, Route: testJournalRoute("20.0.0.0/24", "10.0.0.1")},
+					{Action: opAdd, Route: testJournalRoute("40.0.0.0/24", "10.0.0.1")},
+				}
+				Expect(j.apply(k, func(op *routeOperation, err error) error {
+					return err
+				})).To(MatchError(syscall.EEXIST))
+				return nil
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		j, err := loadJournal(runDir, "dummy", IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j.Operations[0].Done && j.Operations[0].Skipped).To(BeTrue())
+		Expect(!j.Operations[1].Done && j.Operations[1].Skipped).To(BeTrue())
+		Expect(j.rollbackOperations()).To(BeEmpty())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   testConf(),
+		}
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			_, route1, _ := net.ParseCIDR("20.0.0.0/24")
+			Expect(testHasRoute(routes, route1)).To(BeTrue())
+
+			rules, err := netlink.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			tables := []int{}
+			for _, r := range rules {
+				tables = append(tables, r.Table)
+			}
+			Expect(tables).To(ContainElement(100))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		j, err = loadJournal(runDir, "dummy", IFNAME)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(j).To(BeNil())
+	})
+})
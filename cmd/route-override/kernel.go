@@ -0,0 +1,205 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// kernel is the routing table of the container netns, accessed through a
+// single netlink handle. It must be created inside the netns.
+type kernel struct {
+	handle    *netlink.Handle
+	linkIndex map[string]int
+	linkName  map[int]string
+}
+
+// newKernel opens a netlink handle in the current netns and resolves the
+// links once
+func newKernel() (*kernel, error) {
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink handle: %v", err)
+	}
+
+	links, err := h.LinkList()
+	if err != nil {
+		h.Delete()
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+
+	k := &kernel{
+		handle:    h,
+		linkIndex: map[string]int{},
+		linkName:  map[int]string{},
+	}
+	for _, link := range links {
+		k.linkIndex[link.Attrs().Name] = link.Attrs().Index
+		k.linkName[link.Attrs().Index] = link.Attrs().Name
+	}
+	return k, nil
+}
+
+// close releases the netlink handle
+func (k *kernel) close() {
+	k.handle.Delete()
+}
+
+// hasLink returns true if the netns has a link with the given name
+func (k *kernel) hasLink(name string) bool {
+	_, ok := k.linkIndex[name]
+	return ok
+}
+
+// dumpRoutes lists the routes of all tables but the local table, which is
+// maintained by the kernel, with one dump per family
+func (k *kernel) dumpRoutes() ([]*kernelRoute, error) {
+	routes := []*kernelRoute{}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		nlroutes, err := k.handle.RouteListFiltered(family, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes: %v", err)
+		}
+		for i := range nlroutes {
+			if nlroutes[i].Table == syscall.RT_TABLE_LOCAL {
+				continue
+			}
+			routes = append(routes, newKernelRoute(&nlroutes[i], family, k.linkName[nlroutes[i].LinkIndex]))
+		}
+	}
+	return routes, nil
+}
+
+// netlinkRoute resolves the device of the route
+func (k *kernel) netlinkRoute(route *kernelRoute) (*netlink.Route, error) {
+	index, ok := k.linkIndex[route.Dev]
+	if !ok {
+		return nil, fmt.Errorf("failed to find link %q", route.Dev)
+	}
+	return route.netlinkRoute(index), nil
+}
+
+// apply executes the operation. Deleting a route that is already gone is
+// not an error, so that operations can be retried.
+func (k *kernel) apply(op *routeOperation) error {
+	if op.Rule != nil {
+		return k.applyRule(op)
+	}
+	route, err := k.netlinkRoute(op.Route)
+	if err != nil {
+		return err
+	}
+
+	switch op.Action {
+	case opAdd:
+		return k.handle.RouteAdd(route)
+	case opReplace:
+		return k.handle.RouteReplace(route)
+	case opDelete:
+		if err := k.handle.RouteDel(route); err != nil && err != syscall.ESRCH {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown route operation %q", op.Action)
+}
+
+// revert undoes the operation: added routes are removed, deleted routes
+// are restored and replaced routes are reinstalled
+func (k *kernel) revert(op *routeOperation) error {
+	if op.Rule != nil {
+		return k.revertRule(op)
+	}
+	if op.Action == opReplace && op.Replaced != nil {
+		route, err := k.netlinkRoute(op.Replaced)
+		if err != nil {
+			return err
+		}
+		return k.handle.RouteReplace(route)
+	}
+	route, err := k.netlinkRoute(op.Route)
+	if err != nil {
+		return err
+	}
+
+	switch op.Action {
+	case opAdd, opReplace:
+		if err := k.handle.RouteDel(route); err != nil && err != syscall.ESRCH {
+			return err
+		}
+		return nil
+	case opDelete:
+		if err := k.handle.RouteAdd(route); err != nil && err != syscall.EEXIST {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown route operation %q", op.Action)
+}
+
+// applyRule adds or deletes a rule. A rule that is already gone is not an
+// error; adding a rule that already exists returns EEXIST, so that the
+// journal can tell that the add changed nothing.
+func (k *kernel) applyRule(op *routeOperation) error {
+	rule := op.Rule.netlinkRule()
+	switch op.Action {
+	case opAdd:
+		return k.handle.RuleAdd(rule)
+	case opDelete:
+		if err := k.handle.RuleDel(rule); err != nil && err != syscall.ENOENT {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rule operation %q", op.Action)
+}
+
+// revertRule undoes a rule operation
+func (k *kernel) revertRule(op *routeOperation) error {
+	switch op.Action {
+	case opAdd:
+		return k.applyRule(&routeOperation{Action: opDelete, Rule: op.Rule})
+	case opDelete:
+		if err := k.applyRule(&routeOperation{Action: opAdd, Rule: op.Rule}); err != nil && err != syscall.EEXIST {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rule operation %q", op.Action)
+}
+
+// addrLink returns the name of the link with the address, if any
+func (k *kernel) addrLink(ip net.IP) string {
+	for name, index := range k.linkIndex {
+		link, err := k.handle.LinkByIndex(index)
+		if err != nil {
+			continue
+		}
+		addrs, err := k.handle.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return name
+			}
+		}
+	}
+	return ""
+}
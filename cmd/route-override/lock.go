@@ -0,0 +1,139 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRunDir      = "/var/run/cni/route-override"
+	defaultLockTimeout = 30
+	lockPollInterval   = 50 * time.Millisecond
+)
+
+// netnsLock is an exclusive flock held on a per-netns lock file, so that
+// concurrent route-override invocations for the same pod (e.g. several
+// Multus attachments) do not interleave their route changes.
+type netnsLock struct {
+	file *os.File
+}
+
+// netnsLockPath returns the lock file path for the given netns, keyed by
+// the netns inode so that different paths to the same netns share a lock
+func netnsLockPath(runDir, netnsPath string) (string, error) {
+	fi, err := os.Stat(netnsPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat netns %q: %v", netnsPath, err)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("failed to get inode of netns %q", netnsPath)
+	}
+	return filepath.Join(runDir, fmt.Sprintf("netns-%d-%d.lock", st.Dev, st.Ino)), nil
+}
+
+// lockNetns acquires the lock for the given netns, waiting up to timeout.
+// The lock file records the container that holds it, so that DEL can
+// remove it once the netns is gone.
+func lockNetns(runDir, netnsPath, containerID string, timeout time.Duration) (*netnsLock, error) {
+	path, err := netnsLockPath(runDir, netnsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create run directory %q: %v", runDir, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %q: %v", path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %q: %v", path, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out after %v waiting for lock %q on netns %q: another route-override is still running for this netns", timeout, path, netnsPath)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	lock := &netnsLock{file: f}
+	if err := f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(containerID), 0)
+	}
+	if err != nil {
+		lock.Unlock()
+		return nil, fmt.Errorf("failed to write lock file %q: %v", path, err)
+	}
+	return lock, nil
+}
+
+// Unlock releases the lock. The lock file itself is kept because removing
+// it would race with other waiters.
+func (l *netnsLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	defer l.file.Close()
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
+
+// lockNetnsForConf acquires the netns lock with the rundir and timeout
+// given in the configuration
+func lockNetnsForConf(conf *RouteOverrideConfig, containerID, netnsPath string) (*netnsLock, error) {
+	return lockNetns(conf.RunDir, netnsPath, containerID, time.Duration(conf.LockTimeout)*time.Second)
+}
+
+// removeNetnsLocks removes the lock files last held for the container,
+// once its netns is gone. A lock file that is held is left alone, as the
+// netns inode may have been reused by another container.
+func removeNetnsLocks(runDir, containerID string) error {
+	paths, err := filepath.Glob(filepath.Join(runDir, "netns-*.lock"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if owner, err := os.ReadFile(path); err != nil || string(owner) != containerID {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				f.Close()
+				return fmt.Errorf("failed to remove lock file %q: %v", path, err)
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override netns lock", func() {
+	var runDir string
+	var netnsPath string
+
+	BeforeEach(func() {
+		var err error
+		runDir, err = os.MkdirTemp("", "route-override-lock")
+		Expect(err).NotTo(HaveOccurred())
+
+		// any file works as a stand-in for a netns bind mount
+		netnsPath = filepath.Join(runDir, "netns")
+		Expect(os.WriteFile(netnsPath, nil, 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(runDir)).To(Succeed())
+	})
+
+	It("times out while another invocation holds the lock", func() {
+		lock, err := lockNetns(filepath.Join(runDir, "run"), netnsPath, "dummy", time.Second)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = lockNetns(filepath.Join(runDir, "run"), netnsPath, "dummy", 100*time.Millisecond)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("timed out"))
+
+		Expect(lock.Unlock()).To(Succeed())
+
+		lock, err = lockNetns(filepath.Join(runDir, "run"), netnsPath, "dummy", 100*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lock.Unlock()).To(Succeed())
+	})
+
+	It("shares the lock between paths to the same netns", func() {
+		link := filepath.Join(runDir, "netns-link")
+		Expect(os.Symlink(netnsPath, link)).To(Succeed())
+
+		lock, err := lockNetns(filepath.Join(runDir, "run"), netnsPath, "dummy", time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		defer lock.Unlock()
+
+		_, err = lockNetns(filepath.Join(runDir, "run"), link, "dummy", 100*time.Millisecond)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("removes the lock files of a container that are not held", func() {
+		otherPath := filepath.Join(runDir, "other")
+		Expect(os.WriteFile(otherPath, nil, 0600)).To(Succeed())
+		heldPath := filepath.Join(runDir, "held")
+		Expect(os.WriteFile(heldPath, nil, 0600)).To(Succeed())
+
+		lock, err := lockNetns(filepath.Join(runDir, "run"), netnsPath, "dummy", time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lock.Unlock()).To(Succeed())
+		lock, err = lockNetns(filepath.Join(runDir, "run"), otherPath, "other", time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lock.Unlock()).To(Succeed())
+		held, err := lockNetns(filepath.Join(runDir, "run"), heldPath, "dummy", time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		defer held.Unlock()
+
+		Expect(removeNetnsLocks(filepath.Join(runDir, "run"), "dummy")).To(Succeed())
+		for path, exists := range map[string]bool{netnsPath: false, otherPath: true, heldPath: true} {
+			lockPath, err := netnsLockPath(filepath.Join(runDir, "run"), path)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = os.Stat(lockPath)
+			Expect(err == nil).To(Equal(exists), path)
+		}
+	})
+
+	It("tears down a pod despite an invalid configuration or a held lock", func() {
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		conf := []byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"rundir": "` + filepath.Join(runDir, "run") + `",
+			"locktimeout": 1,
+			"args": { "cni": { "addroutes": [null] } }
+		}`)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "net1",
+			Args:        "ROUTE_PROFILE=missing",
+			StdinData:   conf,
+		}
+
+		lock, err := lockNetns(filepath.Join(runDir, "run"), targetNS.Path(), "other", time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmdDel(args)).To(Succeed())
+		Expect(lock.Unlock()).To(Succeed())
+
+		args.Args = ""
+		Expect(cmdDel(args)).To(Succeed())
+		lockPath, err := netnsLockPath(filepath.Join(runDir, "run"), targetNS.Path())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lockPath).To(BeAnExistingFile())
+
+		// the lock file goes away with the netns
+		args.Netns = filepath.Join(runDir, "gone")
+		Expect(cmdDel(args)).To(Succeed())
+		Expect(lockPath).NotTo(BeAnExistingFile())
+	})
+})
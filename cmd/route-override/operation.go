@@ -0,0 +1,143 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	opAdd     = "add"
+	opReplace = "replace"
+	opDelete  = "delete"
+)
+
+// kernelRoute is a route in the container routing table. Unlike
+// netlink.Route it refers to its device by name, always carries a
+// destination (0.0.0.0/0 or ::/0 for default routes) and can be
+// serialized, so that it can be recorded in the journal.
+type kernelRoute struct {
+	Dev      string        `json:"dev"`
+	Dst      types.IPNet   `json:"dst"`
+	Gw       net.IP        `json:"gw,omitempty"`
+	Src      net.IP        `json:"src,omitempty"`
+	Scope    netlink.Scope `json:"scope,omitempty"`
+	Protocol int           `json:"protocol,omitempty"`
+	Priority int           `json:"metric,omitempty"`
+	Table    int           `json:"table,omitempty"`
+	Type     int           `json:"type,omitempty"`
+}
+
+// String formats the route in "ip route" syntax
+func (r *kernelRoute) String() string {
+	dst := net.IPNet(r.Dst)
+	s := dst.String()
+	if r.isDefault() {
+		s = "default"
+	}
+	if r.Gw != nil {
+		s += " via " + r.Gw.String()
+	}
+	s += " dev " + r.Dev
+	if r.Table != 0 && r.Table != syscall.RT_TABLE_MAIN {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	if r.Priority != 0 {
+		s += fmt.Sprintf(" metric %d", r.Priority)
+	}
+	if r.Src != nil {
+		s += " src " + r.Src.String()
+	}
+	return s
+}
+
+// isDefault returns true if the route is a default route
+func (r *kernelRoute) isDefault() bool {
+	ones, _ := net.IPMask(r.Dst.Mask).Size()
+	return ones == 0
+}
+
+// defaultDst returns 0.0.0.0/0 or ::/0 for the given family
+func defaultDst(family int) *net.IPNet {
+	if family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+// newKernelRoute converts a route dumped from the given family into a
+// kernelRoute on device dev
+func newKernelRoute(route *netlink.Route, family int, dev string) *kernelRoute {
+	dst := route.Dst
+	if dst == nil {
+		dst = defaultDst(family)
+	}
+	return &kernelRoute{
+		Dev:      dev,
+		Dst:      types.IPNet(*dst),
+		Gw:       route.Gw,
+		Src:      route.Src,
+		Scope:    route.Scope,
+		Protocol: route.Protocol,
+		Priority: route.Priority,
+		Table:    route.Table,
+		Type:     route.Type,
+	}
+}
+
+// netlinkRoute converts the route back into a netlink.Route for the link
+// with the given index
+func (r *kernelRoute) netlinkRoute(linkIndex int) *netlink.Route {
+	dst := net.IPNet(r.Dst)
+	return &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       &dst,
+		Gw:        r.Gw,
+		Src:       r.Src,
+		Scope:     r.Scope,
+		Protocol:  r.Protocol,
+		Priority:  r.Priority,
+		Table:     r.Table,
+		Type:      r.Type,
+	}
+}
+
+// routeOperation is a single change to the container routing table, or to
+// its policy routing rules if Rule is set
+type routeOperation struct {
+	Action string       `json:"action"`
+	Route  *kernelRoute `json:"route,omitempty"`
+	Rule   *kernelRule  `json:"rule,omitempty"`
+	// Replaced is the route that a replace overwrites, if any, so that a
+	// rollback can reinstall it
+	Replaced *kernelRoute `json:"replaced,omitempty"`
+	Done     bool         `json:"done,omitempty"`
+	// Skipped records that the operation failed or changed nothing, so
+	// that a rollback leaves the routing table alone for it
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+func (op *routeOperation) String() string {
+	if op.Rule != nil {
+		return fmt.Sprintf("%s rule %s", op.Action, op.Rule)
+	}
+	return fmt.Sprintf("%s %s", op.Action, op.Route)
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const (
+	stepFlush   = "flush"
+	stepDelete  = "delete"
+	stepAdd     = "add"
+	stepReplace = "replace"
+	stepRule    = "rule"
+)
+
+// routeMatch selects routes by the attributes it sets. Unlike a route
+// entry it may omit the destination, to match any destination.
+type routeMatch struct {
+	RouteEntry
+	AnyDst bool
+}
+
+// UnmarshalJSON accepts the JSON object form of a route entry, with an
+// optional "dst"
+func (m *routeMatch) UnmarshalJSON(data []byte) error {
+	obj := routeEntryJSON{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	if obj.When != nil {
+		return fmt.Errorf("invalid match %s: when is only supported on routes", data)
+	}
+	entry, err := obj.entry()
+	if err != nil {
+		return fmt.Errorf("invalid match %s: %v", data, err)
+	}
+	m.RouteEntry = *entry
+	m.AnyDst = obj.Dst == ""
+	return nil
+}
+
+// routeStep is a step of the operations pipeline
+type routeStep struct {
+	Op    string      `json:"op"`
+	Match *routeMatch `json:"match,omitempty"`
+	Route *RouteEntry `json:"route,omitempty"`
+	Rule  *kernelRule `json:"rule,omitempty"`
+}
+
+// validate checks that the step has what its op needs
+func (s *routeStep) validate() error {
+	switch s.Op {
+	case stepFlush:
+		if s.Route != nil || s.Rule != nil {
+			return fmt.Errorf("%s takes a match, not a route or rule", s.Op)
+		}
+	case stepDelete, stepAdd, stepReplace:
+		if s.Route == nil || s.Match != nil || s.Rule != nil {
+			return fmt.Errorf("%s takes a route", s.Op)
+		}
+	case stepRule:
+		if s.Rule == nil || s.Match != nil || s.Route != nil {
+			return fmt.Errorf("%s takes a rule", s.Op)
+		}
+	default:
+		return fmt.Errorf("unknown op %q: must be one of flush, delete, add, replace or rule", s.Op)
+	}
+	return nil
+}
+
+// matchesKernel returns true if the kernel route is selected by the match
+func (m *routeMatch) matchesKernel(route *kernelRoute) bool {
+	if !m.AnyDst && dstKey(&m.Dst) != dstKey((*net.IPNet)(&route.Dst)) {
+		return false
+	}
+	return m.RouteEntry.matchesKernel(route)
+}
+
+// matchesResult returns true if the result route is selected by the match
+func (m *routeMatch) matchesResult(route *types.Route, gw net.IP) bool {
+	if m.AnyDst {
+		entry := m.RouteEntry
+		entry.Dst = route.Dst
+		return entry.matchesResult(route, gw)
+	}
+	return m.RouteEntry.matchesResult(route, gw)
+}
+
+// plan computes the operations of the step against the routing table as
+// left by the previous steps, and updates the result routes
+func (s *routeStep) plan(conf *RouteOverrideConfig, res *current.Result, ifNames []string, routes []*kernelRoute) []*routeOperation {
+	ops := []*routeOperation{}
+	switch s.Op {
+	case stepFlush:
+		match := s.Match
+		if match == nil {
+			match = &routeMatch{AnyDst: true}
+		}
+		devs := ifNames
+		if match.Dev != "" {
+			devs = []string{match.Dev}
+		}
+		for _, route := range newRouteTable(routes).devRoutes(devs) {
+			if !isLinkRoute(route) && match.matchesKernel(route) {
+				ops = append(ops, &routeOperation{Action: opDelete, Route: route})
+			}
+		}
+		res.Routes = filterResultRoutes(conf, res.Routes, match.matchesResult)
+
+	case stepDelete:
+		devs := ifNames
+		if s.Route.Dev != "" {
+			devs = []string{s.Route.Dev}
+		}
+		for _, route := range newRouteTable(routes).dstRoutes(&s.Route.Dst, devs) {
+			if s.Route.matchesKernel(route) {
+				ops = append(ops, &routeOperation{Action: opDelete, Route: route})
+			}
+		}
+		res.Routes = filterResultRoutes(conf, res.Routes, s.Route.matchesResult)
+
+	case stepAdd, stepReplace:
+		mode := modeReplace
+		if s.Op == stepAdd {
+			mode = modeAdd
+		}
+		ops = append(ops, addRoute(ifNames[0], s.Route, mode))
+		if s.Route.table() == syscall.RT_TABLE_MAIN {
+			if s.Op == stepReplace {
+				dst := &routeMatch{RouteEntry: RouteEntry{Dst: s.Route.Dst}}
+				res.Routes = filterResultRoutes(conf, res.Routes, dst.matchesResult)
+			}
+			res.Routes = append(res.Routes, s.Route.cniRoute())
+		}
+
+	case stepRule:
+		ops = append(ops, &routeOperation{Action: opAdd, Rule: s.Rule})
+	}
+	return ops
+}
+
+// filterResultRoutes drops the result routes that are selected
+func filterResultRoutes(conf *RouteOverrideConfig, routes []*types.Route, selected func(*types.Route, net.IP) bool) []*types.Route {
+	kept := []*types.Route{}
+	for _, route := range routes {
+		if !selected(route, resultRouteGW(conf.PrevResult, route)) {
+			kept = append(kept, route)
+		}
+	}
+	return kept
+}
+
+// planPipeline runs the steps in order, each against the routing table and
+// result left by the previous steps
+func planPipeline(conf *RouteOverrideConfig, res *current.Result, ifNames []string, routes []*kernelRoute) []*routeOperation {
+	ops := []*routeOperation{}
+	for _, step := range conf.Operations {
+		stepOps := uniqueOperations(step.plan(conf, res, ifNames, routes))
+		routes = simulateOperations(routes, stepOps)
+		ops = append(ops, stepOps...)
+	}
+	return ops
+}
@@ -0,0 +1,231 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"encoding/json"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override operations pipeline", func() {
+	const IFNAME string = "dummy0"
+
+	pipelineConf := func(runDir, operations string) []byte {
+		return []byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"rundir": "` + runDir + `",
+			"operations": ` + operations + `,
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [
+				{
+					"name": "dummy0",
+					"sandbox":"netns"
+				}],
+				"ips": [
+				{
+					"version": "4",
+					"address": "10.0.0.2/24",
+					"gateway": "10.0.0.1",
+					"interface": 0
+				}],
+				"routes": [
+				{
+					"dst": "0.0.0.0/0"
+				},
+				{
+					"dst": "30.0.0.0/24"
+				}]
+			}
+		}`)
+	}
+
+	It("runs the steps in order, each on the outcome of the previous ones", func() {
+		conf, err := parseConf(pipelineConf("/run", `[
+			{"op": "add", "route": "20.0.0.0/24 via 10.0.0.1"},
+			{"op": "replace", "route": "default via 10.0.0.254 metric 10"},
+			{"op": "delete", "route": "default via 10.0.0.1"},
+			{"op": "flush", "match": {"gw": "10.0.0.1"}},
+			{"op": "rule", "rule": "from 10.0.0.2 lookup 200 priority 100"}
+		]`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		linkRoute := testJournalRoute("10.0.0.0/24", "")
+		linkRoute.Scope = netlink.SCOPE_LINK
+		routes := []*kernelRoute{
+			linkRoute,
+			testJournalRoute("0.0.0.0/0", "10.0.0.1"),
+			testJournalRoute("30.0.0.0/24", "10.0.0.1"),
+		}
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"add 20.0.0.0/24 via 10.0.0.1 dev dummy0",
+			"replace default via 10.0.0.254 dev dummy0 metric 10",
+			"delete default via 10.0.0.1 dev dummy0",
+			// the flush sees the route added by the first step
+			"delete 30.0.0.0/24 via 10.0.0.1 dev dummy0",
+			"delete 20.0.0.0/24 via 10.0.0.1 dev dummy0",
+			"add rule from 10.0.0.2/32 lookup 200 priority 100",
+		}))
+
+		Expect(len(plan.Result.Routes)).To(Equal(1))
+		Expect(plan.Result.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(plan.Result.Routes[0].GW.String()).To(Equal("10.0.0.254"))
+	})
+
+	It("validates the steps", func() {
+		for operations, expected := range map[string]string{
+			`[{"op": "move"}]`:                             `operations[0]: unknown op "move": must be one of flush, delete, add, replace or rule`,
+			`[{"op": "flush"}, {"op": "add"}]`:             `operations[1]: add takes a route`,
+			`[{"op": "rule", "route": "10.0.0.0/8"}]`:      `operations[0]: rule takes a rule`,
+			`[{"op": "rule", "rule": "from all"}]`:         `invalid rule "from all": missing table`,
+			`[{"op": "rule", "rule": "from all goto 10"}]`: `invalid rule "from all goto 10": unknown keyword "goto"`,
+			`[null]`: `operations[0]: missing op`,
+		} {
+			_, err := parseConf(pipelineConf("/run", operations), "")
+			Expect(err).To(MatchError(ContainSubstring(expected)), operations)
+		}
+
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"flushgateway": true,
+			"operations": []
+		}`), "")
+		Expect(err).To(MatchError(ContainSubstring("operations cannot be combined with")))
+	})
+
+	It("records rules in the journal", func() {
+		rule, err := parseRuleEntry("from fd00::/64 to fd01::/64 iif net1 fwmark 0x10 table main pref 5")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rule.Family).To(Equal(netlink.FAMILY_V6))
+		Expect(rule.String()).To(Equal("from fd00::/64 to fd01::/64 iif net1 fwmark 0x10 lookup main priority 5"))
+
+		data, err := json.Marshal(&routeOperation{Action: opAdd, Rule: rule})
+		Expect(err).NotTo(HaveOccurred())
+		op := &routeOperation{}
+		Expect(json.Unmarshal(data, op)).To(Succeed())
+		Expect(op.Rule).To(Equal(rule))
+	})
+
+	It("takes the family of a rule without addresses from -4 or -6", func() {
+		rule, err := parseRuleEntry("-6 from all lookup 100")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rule.Family).To(Equal(netlink.FAMILY_V6))
+		Expect(rule.netlinkRule().Family).To(Equal(netlink.FAMILY_V6))
+		Expect(rule.String()).To(Equal("-6 from all lookup 100"))
+
+		again, err := parseRuleEntry(rule.String())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(rule))
+
+		rule, err = parseRuleEntry("-4 fwmark 0x10 lookup 100")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rule.Family).To(Equal(netlink.FAMILY_V4))
+		Expect(rule.String()).To(Equal("from all fwmark 0x10 lookup 100"))
+
+		_, err = parseRuleEntry("-4 to fd01::/64 lookup 100")
+		Expect(err).To(MatchError(`invalid rule "-4 to fd01::/64 lookup 100": to fd01::/64 is not of the family given by -4`))
+	})
+
+	It("applies the pipeline to the netns", func() {
+		originalNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer originalNS.Close()
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+		runDir, err := os.MkdirTemp("", "route-override-pipeline")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(runDir)
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := netlink.LinkAdd(&netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IFNAME,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+			Expect(testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))).To(Succeed())
+			Expect(testAddRoute(link, net.IPv4(0, 0, 0, 0), net.CIDRMask(0, 0), net.IPv4(10, 0, 0, 1))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData: pipelineConf(runDir, `[
+				{"op": "add", "route": "default via 10.0.0.254 metric 10"},
+				{"op": "delete", "route": "default via 10.0.0.1"},
+				{"op": "rule", "rule": "from 10.0.0.2 lookup 200 priority 100"}
+			]`),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: nil}, netlink.RT_FILTER_DST)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(routes)).To(Equal(1))
+			Expect(routes[0].Gw.String()).To(Equal("10.0.0.254"))
+
+			rules, err := netlink.RuleList(netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			found := false
+			for _, rule := range rules {
+				if rule.Priority == 100 && rule.Table == 200 {
+					found = true
+				}
+			}
+			Expect(found).To(BeTrue())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,307 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"github.com/vishvananda/netlink"
+)
+
+// routePlan is the outcome of planning: the operations to apply to the
+// routing table, in order, and the result to return to the runtime
+type routePlan struct {
+	Operations []*routeOperation
+	Result     *current.Result
+	// Warnings report the operations that were left out
+	Warnings []string
+}
+
+// copyResult returns a deep copy of the result, so that planning does not
+// modify the prevResult of the configuration
+func copyResult(res *current.Result) (*current.Result, error) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+	newResult := &current.Result{}
+	if err := json.Unmarshal(data, newResult); err != nil {
+		return nil, fmt.Errorf("could not copy prevResult: %v", err)
+	}
+	return newResult, nil
+}
+
+// planRoutes computes the operations needed to override the routes of the
+// given container interfaces, see containerIfNames, given the current
+// routes in the container netns. It neither touches the kernel nor
+// modifies conf. No operation removes a protected route, and replace
+// operations record the route they overwrite.
+func planRoutes(conf *RouteOverrideConfig, ifNames []string, routes []*kernelRoute) (*routePlan, error) {
+	plan, err := planOverride(conf, ifNames, routes)
+	if err != nil {
+		return nil, err
+	}
+	// rules are added once the routes are in place
+	ruleOps := []*routeOperation{}
+	for _, rule := range conf.Rules {
+		ruleOps = append(ruleOps, &routeOperation{Action: opAdd, Rule: rule})
+	}
+	plan.Operations = append(plan.Operations, uniqueOperations(ruleOps)...)
+	if err := guardProtectedRoutes(conf, plan, routes); err != nil {
+		return nil, err
+	}
+	recordReplaced(routes, plan.Operations)
+	return plan, nil
+}
+
+// planOverride plans the configured route changes
+func planOverride(conf *RouteOverrideConfig, ifNames []string, routes []*kernelRoute) (*routePlan, error) {
+	if conf.PrevResult == nil {
+		return nil, fmt.Errorf("required prevResult missing")
+	}
+	res, err := copyResult(conf.PrevResult)
+	if err != nil {
+		return nil, err
+	}
+	if conf, err = conf.resolve(ifNames); err != nil {
+		return nil, err
+	}
+
+	if conf.Operations != nil {
+		return &routePlan{
+			Operations: planPipeline(conf, res, ifNames, routes),
+			Result:     res,
+		}, nil
+	}
+
+	if conf.Routes != nil {
+		res.Routes = desiredResult(conf)
+		return &routePlan{
+			Operations: uniqueOperations(planDesiredRoutes(conf, ifNames, routes)),
+			Result:     res,
+		}, nil
+	}
+
+	table := newRouteTable(routes)
+	ops := []*routeOperation{}
+	dropped := map[*types.Route]bool{}
+	allRoutes := conf.interfaceRoutes(ifNames)
+	for _, ifRoutes := range allRoutes {
+		ops = append(ops, planInterfaceDeletes(conf, ifRoutes, table, res, dropped)...)
+	}
+
+	// delete given gateway address
+	for _, ip := range res.IPs {
+		name := ipInterface(res, ip, ifNames)
+		for _, ifRoutes := range allRoutes {
+			if ifRoutes.Name != name || !ifRoutes.FlushGateway {
+				continue
+			}
+			if ip.Address.IP.To4() == nil {
+				ip.Gateway = net.IPv6zero
+			} else {
+				ip.Gateway = net.IPv4zero
+			}
+		}
+	}
+
+	newRoutes := []*types.Route{}
+	for _, route := range res.Routes {
+		if !dropped[route] {
+			newRoutes = append(newRoutes, route)
+		}
+	}
+
+	// Add route
+	for _, ifRoutes := range allRoutes {
+		for _, route := range ifRoutes.AddRoutes {
+			// the result only reports routes of the main table
+			if route.table() == syscall.RT_TABLE_MAIN {
+				newRoutes = append(newRoutes, route.cniRoute())
+			}
+			ops = append(ops, addRoute(ifRoutes.Name, route, conf.Mode))
+		}
+	}
+	res.Routes = newRoutes
+
+	// hand the default route over once the other routes are in place
+	if conf.DefaultRoute != nil {
+		defaultOps, err := planDefaultRoutes(conf, res, ifNames[0], simulateOperations(routes, ops))
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, defaultOps...)
+	}
+
+	return &routePlan{
+		Operations: uniqueOperations(ops),
+		Result:     res,
+	}, nil
+}
+
+// planInterfaceDeletes computes the flushes and deletions of a container
+// interface, and marks the result routes they drop
+func planInterfaceDeletes(conf *RouteOverrideConfig, ifRoutes *interfaceRoutes, table *routeTable, res *current.Result, dropped map[*types.Route]bool) []*routeOperation {
+	ifNames := []string{ifRoutes.Name}
+	delRoutes := append([]*RouteEntry{}, ifRoutes.DelRoutes...)
+	if ifRoutes.FlushGateway {
+		// add "0.0.0.0/0" into delRoute to remove it from routing table/result
+		delRoutes = append(delRoutes, &RouteEntry{Dst: *defaultDst(netlink.FAMILY_V4)})
+		delRoutes = append(delRoutes, &RouteEntry{Dst: *defaultDst(netlink.FAMILY_V6)})
+	}
+
+	ops := []*routeOperation{}
+	// Flush route if required
+	if !ifRoutes.FlushRoutes {
+	NEXT:
+		for _, route := range res.Routes {
+			gw := resultRouteGW(conf.PrevResult, route)
+			for _, delroute := range delRoutes {
+				if delroute.matchesResult(route, gw) {
+					ops = append(ops, deleteRoute(table, delroute, ifNames)...)
+					if !ifRoutes.keepsResult(route, gw) {
+						dropped[route] = true
+					}
+					continue NEXT
+				}
+
+			}
+		}
+	} else {
+		ops = append(ops, deleteAllRoutes(table, ifNames)...)
+		for _, route := range res.Routes {
+			if !ifRoutes.keepsResult(route, resultRouteGW(conf.PrevResult, route)) {
+				dropped[route] = true
+			}
+		}
+	}
+
+	if ifRoutes.FlushGateway {
+		ops = append(ops, deleteGWRoute(table, ifNames)...)
+	}
+
+	kept := []*routeOperation{}
+	for _, op := range ops {
+		if !ifRoutes.keeps(op.Route) {
+			kept = append(kept, op)
+		}
+	}
+	return kept
+}
+
+// resultRouteGW returns the gateway of a result route, which defaults to
+// the gateway of the address of the same family
+func resultRouteGW(res *current.Result, route *types.Route) net.IP {
+	if route.GW != nil {
+		return route.GW
+	}
+	v4 := route.Dst.IP.To4() != nil
+	for _, ip := range res.IPs {
+		if ip.Gateway != nil && (ip.Address.IP.To4() != nil) == v4 {
+			return ip.Gateway
+		}
+	}
+	return nil
+}
+
+func deleteAllRoutes(table *routeTable, ifNames []string) []*routeOperation {
+	ops := []*routeOperation{}
+	for _, route := range table.devRoutes(ifNames) {
+		// routes via link-local gateways are flushed like others, but the
+		// kernel's link routes are kept
+		if route.Table != syscall.RT_TABLE_MAIN || isLinkRoute(route) {
+			continue
+		}
+		if route.isDefault() || route.Gw != nil {
+			ops = append(ops, &routeOperation{Action: opDelete, Route: route})
+		}
+	}
+
+	return ops
+}
+
+func deleteGWRoute(table *routeTable, ifNames []string) []*routeOperation {
+	ops := []*routeOperation{}
+	for _, route := range table.devRoutes(ifNames) {
+		if route.Table == syscall.RT_TABLE_MAIN && route.isDefault() {
+			ops = append(ops, &routeOperation{Action: opDelete, Route: route})
+		}
+	}
+
+	return ops
+}
+
+// deleteRoute deletes the routes matching the entry on the given device,
+// or on the container interfaces if the entry has none
+func deleteRoute(table *routeTable, route *RouteEntry, ifNames []string) []*routeOperation {
+	if route.Dev != "" {
+		ifNames = []string{route.Dev}
+	}
+
+	ops := []*routeOperation{}
+	for _, nlroute := range table.dstRoutes(&route.Dst, ifNames) {
+		if !nlroute.isDefault() && route.matchesKernel(nlroute) {
+			ops = append(ops, &routeOperation{Action: opDelete, Route: nlroute})
+		}
+	}
+
+	return ops
+}
+
+// addRoute installs the route on its device, or on the container interface
+// if the entry has none
+func addRoute(dev string, route *RouteEntry, mode string) *routeOperation {
+	action := opReplace
+	if mode == modeAdd {
+		action = opAdd
+	}
+	if route.Dev != "" {
+		dev = route.Dev
+	}
+	return &routeOperation{
+		Action: action,
+		Route: &kernelRoute{
+			Dev:      dev,
+			Dst:      types.IPNet(route.Dst),
+			Gw:       route.GW,
+			Src:      route.Src,
+			Scope:    route.Scope,
+			Protocol: route.Protocol,
+			Priority: route.Metric,
+			Table:    route.Table,
+		},
+	}
+}
+
+// uniqueOperations drops repeated operations, keeping the first one (e.g. a
+// default route matched by both flushroutes and flushgateway)
+func uniqueOperations(ops []*routeOperation) []*routeOperation {
+	seen := make(map[string]bool, len(ops))
+	unique := make([]*routeOperation, 0, len(ops))
+	for _, op := range ops {
+		key := op.String()
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, op)
+		}
+	}
+	return unique
+}
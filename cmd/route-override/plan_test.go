@@ -0,0 +1,190 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testPlanOperations formats the planned operations for comparison
+func testPlanOperations(plan *routePlan) []string {
+	ops := []string{}
+	for _, op := range plan.Operations {
+		ops = append(ops, op.String())
+	}
+	return ops
+}
+
+var _ = Describe("route-override planning", func() {
+	var routes []*kernelRoute
+
+	BeforeEach(func() {
+		linkRoute := testJournalRoute("10.0.0.0/24", "")
+		linkRoute.Scope = netlink.SCOPE_LINK
+		routes = []*kernelRoute{
+			linkRoute,
+			testJournalRoute("0.0.0.0/0", "10.0.0.1"),
+			testJournalRoute("30.0.0.0/24", "10.0.0.1"),
+			testJournalRoute("20.0.0.0/24", "10.0.0.254"),
+		}
+	})
+
+	prevResult := `"prevResult": {
+		"cniVersion": "0.3.1",
+		"interfaces": [
+		{
+			"name": "dummy0",
+			"sandbox":"netns"
+		}],
+		"ips": [
+		{
+			"version": "4",
+			"address": "10.0.0.2/24",
+			"gateway": "10.0.0.1",
+			"interface": 0
+		}],
+		"routes": [
+		{
+			"dst": "0.0.0.0/0"
+		},
+		{
+			"dst": "30.0.0.0/24"
+		},
+		{
+			"dst": "20.0.0.0/24",
+			"gw": "10.0.0.254"
+		}]
+	}`
+
+	It("installs routes via link-local gateways without device on the container interface", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": [{ "dst": "::/0", "gw": "fe80::1" }],
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{"replace default via fe80::1 dev dummy0"}))
+	})
+
+	It("plans delroutes before addroutes", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"delroutes": [{ "dst": "30.0.0.0/24" }],
+			"addroutes": [{ "dst": "40.0.0.0/24", "gw": "10.0.0.253" }],
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"delete 30.0.0.0/24 via 10.0.0.1 dev dummy0",
+			"replace 40.0.0.0/24 via 10.0.0.253 dev dummy0",
+		}))
+
+		Expect(len(plan.Result.Routes)).To(Equal(3))
+		Expect(plan.Result.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(plan.Result.Routes[1].Dst.String()).To(Equal("20.0.0.0/24"))
+		Expect(plan.Result.Routes[2].Dst.String()).To(Equal("40.0.0.0/24"))
+	})
+
+	It("plans flushgateway without modifying the configuration", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"flushgateway": true,
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"delete default via 10.0.0.1 dev dummy0",
+		}))
+		Expect(plan.Result.IPs[0].Gateway.String()).To(Equal("0.0.0.0"))
+		Expect(len(plan.Result.Routes)).To(Equal(2))
+
+		// planning twice gives the same plan
+		Expect(len(conf.DelRoutes)).To(Equal(0))
+		Expect(conf.PrevResult.IPs[0].Gateway.String()).To(Equal("10.0.0.1"))
+		again, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(plan))
+	})
+
+	It("plans flushroutes keeping link routes", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"flushroutes": true,
+			"flushgateway": true,
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"delete default via 10.0.0.1 dev dummy0",
+			"delete 30.0.0.0/24 via 10.0.0.1 dev dummy0",
+			"delete 20.0.0.0/24 via 10.0.0.254 dev dummy0",
+		}))
+		Expect(len(plan.Result.Routes)).To(Equal(0))
+	})
+
+	It("plans routes in ip route syntax", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"delroutes": ["30.0.0.0/24 via 10.0.0.254", "20.0.0.0/24 via 10.0.0.254"],
+			"addroutes": [
+				"40.0.0.0/24 via 10.0.0.253 metric 100",
+				"50.0.0.0/24 via 10.0.0.253 dev net1 table 200"
+			],
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"delete 20.0.0.0/24 via 10.0.0.254 dev dummy0",
+			"replace 40.0.0.0/24 via 10.0.0.253 dev dummy0 metric 100",
+			"replace 50.0.0.0/24 via 10.0.0.253 dev net1 table 200",
+		}))
+
+		// routes of other tables are not part of the result
+		Expect(len(plan.Result.Routes)).To(Equal(3))
+		Expect(plan.Result.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(plan.Result.Routes[1].Dst.String()).To(Equal("30.0.0.0/24"))
+		Expect(plan.Result.Routes[2].Dst.String()).To(Equal("40.0.0.0/24"))
+	})
+})
@@ -0,0 +1,235 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// CNIArgs are the CNI_ARGS keys route-override understands. Other keys are
+// ignored.
+type CNIArgs struct {
+	K8S_POD_NAMESPACE          types.UnmarshallableString //revive:disable-line
+	K8S_POD_NAME               types.UnmarshallableString //revive:disable-line
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString //revive:disable-line
+	K8S_POD_UID                types.UnmarshallableString //revive:disable-line
+	ROUTE_PROFILE              types.UnmarshallableString //revive:disable-line
+
+	// pairs are all keys and values, for cniArg conditions
+	pairs map[string]string
+}
+
+// parseCNIArgs parses the CNI_ARGS key=value pairs. Unlike types.LoadArgs,
+// it skips unknown keys and malformed pairs even without IgnoreUnknown, as
+// runtimes pass keys meant for other plugins.
+func parseCNIArgs(envArgs string) *CNIArgs {
+	args := &CNIArgs{pairs: map[string]string{}}
+	for _, pair := range strings.Split(envArgs, ";") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			args.pairs[kv[0]] = kv[1]
+		}
+	}
+	args.K8S_POD_NAMESPACE = types.UnmarshallableString(args.pairs["K8S_POD_NAMESPACE"])
+	args.K8S_POD_NAME = types.UnmarshallableString(args.pairs["K8S_POD_NAME"])
+	args.K8S_POD_INFRA_CONTAINER_ID = types.UnmarshallableString(args.pairs["K8S_POD_INFRA_CONTAINER_ID"])
+	args.K8S_POD_UID = types.UnmarshallableString(args.pairs["K8S_POD_UID"])
+	args.ROUTE_PROFILE = types.UnmarshallableString(args.pairs["ROUTE_PROFILE"])
+	return args
+}
+
+// profileMatch selects a profile by pod
+type profileMatch struct {
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+}
+
+// validate checks that the match selects something and that its patterns
+// are valid globs
+func (m *profileMatch) validate() error {
+	if m.Namespace == "" && m.Pod == "" {
+		return fmt.Errorf("match needs a namespace or pod pattern")
+	}
+	for _, pattern := range []string{m.Namespace, m.Pod} {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the pod matches all patterns of the match
+func (m *profileMatch) matches(namespace, pod string) bool {
+	for _, p := range []struct{ pattern, value string }{{m.Namespace, namespace}, {m.Pod, pod}} {
+		if p.pattern == "" {
+			continue
+		}
+		if ok, _ := filepath.Match(p.pattern, p.value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// profileReservedKeys cannot be set by a profile
+var profileReservedKeys = map[string]bool{
+	"cniVersion": true, "name": true, "type": true, "prevResult": true,
+	"profiles": true, "args": true, "runtimeConfig": true, "capabilities": true,
+}
+
+// profileCondition returns the when clause of the profile, if any
+func profileCondition(name string, profile map[string]json.RawMessage) (*RouteCondition, error) {
+	rawWhen, ok := profile["when"]
+	if !ok {
+		return nil, nil
+	}
+	when := &RouteCondition{}
+	if err := json.Unmarshal(rawWhen, when); err != nil {
+		return nil, fmt.Errorf("profile %q: invalid when: %v", name, err)
+	}
+	return when, nil
+}
+
+// selectProfile returns the name of the profile for the pod: the one named
+// by ROUTE_PROFILE, or else the first one, in sorted order, whose match
+// selects the pod. A profile with a when clause is only selected if its
+// conditions hold. It returns "" if no profile applies.
+func selectProfile(profiles map[string]map[string]json.RawMessage, args *CNIArgs, ctx *whenContext) (string, error) {
+	applies := func(name string) (bool, error) {
+		when, err := profileCondition(name, profiles[name])
+		if err != nil || when == nil {
+			return true, err
+		}
+		return when.holds(ctx), nil
+	}
+
+	if name := string(args.ROUTE_PROFILE); name != "" {
+		if _, ok := profiles[name]; !ok {
+			return "", fmt.Errorf("unknown profile %q in ROUTE_PROFILE", name)
+		}
+		if ok, err := applies(name); err != nil || !ok {
+			return "", err
+		}
+		return name, nil
+	}
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rawMatch, hasMatch := profiles[name]["match"]
+		_, hasWhen := profiles[name]["when"]
+		if !hasMatch && !hasWhen {
+			continue
+		}
+		if hasMatch {
+			match := &profileMatch{}
+			if err := json.Unmarshal(rawMatch, match); err != nil {
+				return "", fmt.Errorf("profile %q: invalid match: %v", name, err)
+			}
+			if !match.matches(string(args.K8S_POD_NAMESPACE), string(args.K8S_POD_NAME)) {
+				continue
+			}
+		}
+		ok, err := applies(name)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// applyProfile overlays the keys of the profile selected for the pod onto
+// the top-level keys of the configuration
+func applyProfile(data []byte, args *CNIArgs) ([]byte, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	rawProfiles, ok := raw["profiles"]
+	if !ok {
+		return data, nil
+	}
+	profiles := map[string]map[string]json.RawMessage{}
+	if err := json.Unmarshal(rawProfiles, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles: %v", err)
+	}
+
+	// every profile is checked, not only the selected one
+	hasWhen := false
+	for name, profile := range profiles {
+		for key := range profile {
+			if profileReservedKeys[key] {
+				return nil, fmt.Errorf("profile %q: %q cannot be set by a profile", name, key)
+			}
+		}
+		when, err := profileCondition(name, profile)
+		if err != nil {
+			return nil, err
+		}
+		if when != nil {
+			hasWhen = true
+			if err := when.validate(); err != nil {
+				return nil, fmt.Errorf("profile %q: invalid when: %v", name, err)
+			}
+		}
+		if rawMatch, ok := profile["match"]; ok {
+			match := &profileMatch{}
+			if err := json.Unmarshal(rawMatch, match); err != nil {
+				return nil, fmt.Errorf("profile %q: invalid match: %v", name, err)
+			}
+			if err := match.validate(); err != nil {
+				return nil, fmt.Errorf("profile %q: %v", name, err)
+			}
+		}
+	}
+
+	// conditions are evaluated against the previous result
+	ctx := profileWhenContext(nil, args)
+	if rawPrevResult, ok := raw["prevResult"]; ok && hasWhen {
+		var cniVersion string
+		if rawVersion, ok := raw["cniVersion"]; ok {
+			if err := json.Unmarshal(rawVersion, &cniVersion); err != nil {
+				return nil, fmt.Errorf("invalid cniVersion: %v", err)
+			}
+		}
+		res, err := parsePrevResult(cniVersion, rawPrevResult)
+		if err != nil {
+			return nil, err
+		}
+		ctx = profileWhenContext(res, args)
+	}
+
+	name, err := selectProfile(profiles, args, ctx)
+	if err != nil || name == "" {
+		return data, err
+	}
+	for key, value := range profiles[name] {
+		if key != "match" && key != "when" {
+			raw[key] = value
+		}
+	}
+	return json.Marshal(raw)
+}
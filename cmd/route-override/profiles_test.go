@@ -0,0 +1,107 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override profiles", func() {
+	conf := []byte(`{
+		"name": "test",
+		"type": "route-override",
+		"cniVersion": "0.3.1",
+		"flushgateway": true,
+		"addroutes": ["10.10.0.0/16 via 10.1.0.1"],
+		"profiles": {
+			"tenant-a": {
+				"match": {"namespace": "tenant-a*"},
+				"addroutes": ["10.20.0.0/16 via 10.1.0.1"]
+			},
+			"tenant-b-web": {
+				"match": {"namespace": "tenant-b", "pod": "web-*"},
+				"flushgateway": false
+			},
+			"manual": {
+				"flushroutes": true
+			}
+		}
+	}`)
+
+	addRoutes := func(conf *RouteOverrideConfig) []string {
+		routes := []string{}
+		for _, route := range conf.AddRoutes {
+			routes = append(routes, route.String())
+		}
+		return routes
+	}
+
+	It("selects the profile by namespace and pod", func() {
+		c, err := parseConf(conf, "IgnoreUnknown=1;K8S_POD_NAMESPACE=tenant-a-prod;K8S_POD_NAME=db-0;K8S_POD_UID=1234;OTHER=x")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addRoutes(c)).To(Equal([]string{"10.20.0.0/16 via 10.1.0.1"}))
+		Expect(c.FlushGateway).To(BeTrue())
+
+		c, err = parseConf(conf, "K8S_POD_NAMESPACE=tenant-b;K8S_POD_NAME=web-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addRoutes(c)).To(Equal([]string{"10.10.0.0/16 via 10.1.0.1"}))
+		Expect(c.FlushGateway).To(BeFalse())
+
+		// no profile matches
+		c, err = parseConf(conf, "K8S_POD_NAMESPACE=tenant-b;K8S_POD_NAME=db-0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addRoutes(c)).To(Equal([]string{"10.10.0.0/16 via 10.1.0.1"}))
+		Expect(c.FlushGateway).To(BeTrue())
+		Expect(c.FlushRoutes).To(BeFalse())
+	})
+
+	It("selects the profile named by ROUTE_PROFILE", func() {
+		c, err := parseConf(conf, "K8S_POD_NAMESPACE=tenant-a;ROUTE_PROFILE=manual")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.FlushRoutes).To(BeTrue())
+		Expect(addRoutes(c)).To(Equal([]string{"10.10.0.0/16 via 10.1.0.1"}))
+
+		_, err = parseConf(conf, "ROUTE_PROFILE=missing")
+		Expect(err).To(MatchError(`failed to load netconf: unknown profile "missing" in ROUTE_PROFILE`))
+	})
+
+	It("ignores unknown CNI_ARGS keys without IgnoreUnknown", func() {
+		c, err := parseConf(conf, "K8S_POD_NAMESPACE=tenant-a-prod;K8S_POD_NAME=db-0;OTHER=x;malformed")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addRoutes(c)).To(Equal([]string{"10.20.0.0/16 via 10.1.0.1"}))
+		Expect(validateConf(conf, "K8S_POD_NAME=web-1;OTHER=x")).To(Succeed())
+	})
+
+	It("rejects invalid profiles", func() {
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"profiles": {"bad": {"type": "other"}}
+		}`), "")
+		Expect(err).To(MatchError(`failed to load netconf: profile "bad": "type" cannot be set by a profile`))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"profiles": {"bad": {"match": {}}}
+		}`), "")
+		Expect(err).To(MatchError(`failed to load netconf: profile "bad": match needs a namespace or pod pattern`))
+	})
+})
@@ -0,0 +1,152 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const (
+	// onProtectedFail fails ADD if it would remove a protected route
+	onProtectedFail = "fail"
+	// onProtectedSkip leaves protected routes in place with a warning
+	onProtectedSkip = "skip"
+)
+
+// nodeProtectedRoutesFile is read on every invocation if it exists, so that
+// cluster admins can protect routes independently of the network
+// configuration
+var nodeProtectedRoutesFile = "/etc/cni/route-override/protectedroutes"
+
+// loadProtectedRoutes appends the entries of the node-level file and of
+// protectedroutesfile to the inline protectedroutes
+func (conf *RouteOverrideConfig) loadProtectedRoutes() error {
+	paths := []string{}
+	if _, err := os.Stat(nodeProtectedRoutesFile); err == nil {
+		paths = append(paths, nodeProtectedRoutesFile)
+	}
+	if conf.ProtectedRoutesFile != "" {
+		paths = append(paths, conf.ProtectedRoutesFile)
+	}
+	for _, path := range paths {
+		routes, err := loadRoutesFile(path)
+		if err != nil {
+			return err
+		}
+		if err := validateProtectedRoutes(routes); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		conf.ProtectedRoutes = append(conf.ProtectedRoutes, routes...)
+	}
+	return nil
+}
+
+// validateProtectedRoutes rejects entries that only make sense once they
+// are resolved for an interface
+func validateProtectedRoutes(routes []*RouteEntry) error {
+	if err := nullRoute("protectedroutes", routes); err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.template != "" || route.When != nil {
+			return fmt.Errorf("protected route %v cannot be a template or have conditions", route)
+		}
+	}
+	return nil
+}
+
+// protectedRoute returns the protected entry that matches the kernel route,
+// if any
+func (conf *RouteOverrideConfig) protectedRoute(route *kernelRoute) *RouteEntry {
+	for _, protected := range conf.ProtectedRoutes {
+		if protected.Dev != "" && protected.Dev != route.Dev {
+			continue
+		}
+		if dstKey(&protected.Dst) == dstKey((*net.IPNet)(&route.Dst)) && protected.matchesKernel(route) {
+			return protected
+		}
+	}
+	return nil
+}
+
+// guardProtectedRoutes checks the planned operations against the
+// protected routes. An operation that would remove a protected route fails
+// the plan or, with onprotected set to skip, is left out with a warning,
+// and the route stays in the result.
+func guardProtectedRoutes(conf *RouteOverrideConfig, plan *routePlan, routes []*kernelRoute) error {
+	if len(conf.ProtectedRoutes) == 0 {
+		return nil
+	}
+
+	table := routes
+	ops := []*routeOperation{}
+	for _, op := range plan.Operations {
+		if op.Route == nil {
+			ops = append(ops, op)
+			continue
+		}
+		route := op.kernelRoute()
+		var victim *kernelRoute
+		for _, r := range table {
+			// replacing a route with itself keeps it
+			if op.Action == opReplace && sameRoute(route, r) {
+				continue
+			}
+			if op.removes(route, r) && conf.protectedRoute(r) != nil {
+				victim = r
+				break
+			}
+		}
+		if victim == nil {
+			ops = append(ops, op)
+			table = simulateOperations(table, []*routeOperation{op})
+			continue
+		}
+
+		if conf.OnProtected != onProtectedSkip {
+			return fmt.Errorf("route-override: refusing to %v: %v is protected by %v", op, victim, conf.protectedRoute(victim))
+		}
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("skipping %v: %v is protected", op, victim))
+		keepResultRoute(conf.PrevResult, plan.Result, victim)
+	}
+	plan.Operations = ops
+	return nil
+}
+
+// keepResultRoute puts the routes of the previous result that the kernel
+// route stands for back into the result, if planning dropped them
+func keepResultRoute(prevResult, res *current.Result, route *kernelRoute) {
+	dst := dstKey((*net.IPNet)(&route.Dst))
+	for _, prev := range prevResult.Routes {
+		if dstKey(&prev.Dst) != dst || (prev.GW != nil && !prev.GW.Equal(route.Gw)) {
+			continue
+		}
+		found := false
+		for _, r := range res.Routes {
+			if dstKey(&r.Dst) == dst && r.GW.Equal(prev.GW) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res.Routes = append(res.Routes, &types.Route{Dst: prev.Dst, GW: prev.GW})
+		}
+	}
+}
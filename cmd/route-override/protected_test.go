@@ -0,0 +1,160 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override protected routes", func() {
+	var routes []*kernelRoute
+
+	BeforeEach(func() {
+		routes = []*kernelRoute{
+			testJournalRoute("0.0.0.0/0", "10.0.0.1"),
+			testJournalRoute("10.96.0.0/12", "10.0.0.1"),
+			testJournalRoute("30.0.0.0/24", "10.0.0.1"),
+		}
+	})
+
+	testConf := func(settings string) *RouteOverrideConfig {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			`+settings+`
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{ "name": "dummy0", "sandbox": "netns" }],
+				"ips": [{ "version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0 }],
+				"routes": [{ "dst": "0.0.0.0/0" }, { "dst": "10.96.0.0/12" }, { "dst": "30.0.0.0/24" }]
+			}
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		return conf
+	}
+
+	It("fails to remove a protected route", func() {
+		conf := testConf(`"flushroutes": true, "protectedroutes": ["10.96.0.0/12"],`)
+		_, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).To(MatchError("route-override: refusing to delete 10.96.0.0/12 via 10.0.0.1 dev dummy0: 10.96.0.0/12 via 10.0.0.1 dev dummy0 is protected by 10.96.0.0/12"))
+
+		// replacing it with another gateway removes it too
+		conf = testConf(`"addroutes": ["10.96.0.0/12 via 10.0.0.254"], "protectedroutes": ["10.96.0.0/12"],`)
+		_, err = planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).To(MatchError(ContainSubstring("refusing to replace 10.96.0.0/12 via 10.0.0.254 dev dummy0")))
+
+		// but not replacing it with itself
+		conf = testConf(`"addroutes": ["10.96.0.0/12 via 10.0.0.1"], "protectedroutes": ["10.96.0.0/12"],`)
+		_, err = planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("skips removing protected routes when configured to", func() {
+		conf := testConf(`"flushroutes": true, "flushgateway": true, "onprotected": "skip",
+			"protectedroutes": ["10.96.0.0/12", "default via 10.0.0.1"],`)
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"delete 30.0.0.0/24 via 10.0.0.1 dev dummy0",
+		}))
+		Expect(plan.Warnings).To(Equal([]string{
+			"skipping delete default via 10.0.0.1 dev dummy0: default via 10.0.0.1 dev dummy0 is protected",
+			"skipping delete 10.96.0.0/12 via 10.0.0.1 dev dummy0: 10.96.0.0/12 via 10.0.0.1 dev dummy0 is protected",
+		}))
+		Expect(len(plan.Result.Routes)).To(Equal(2))
+		Expect(plan.Result.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+		Expect(plan.Result.Routes[1].Dst.String()).To(Equal("10.96.0.0/12"))
+	})
+
+	It("protects only the given gateway", func() {
+		conf := testConf(`"delroutes": ["30.0.0.0/24"], "protectedroutes": ["30.0.0.0/24 via 10.0.0.254"],`)
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"delete 30.0.0.0/24 via 10.0.0.1 dev dummy0",
+		}))
+	})
+
+	It("loads protected routes from the node and from protectedroutesfile", func() {
+		dir, err := os.MkdirTemp("", "route-override-protected")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		nodeFile := filepath.Join(dir, "node")
+		Expect(os.WriteFile(nodeFile, []byte("# cluster network\n10.96.0.0/12\n"), 0644)).To(Succeed())
+		confFile := filepath.Join(dir, "conf")
+		Expect(os.WriteFile(confFile, []byte(`["30.0.0.0/24 via 10.0.0.1"]`), 0644)).To(Succeed())
+
+		saved := nodeProtectedRoutesFile
+		nodeProtectedRoutesFile = nodeFile
+		defer func() { nodeProtectedRoutesFile = saved }()
+
+		conf := testConf(`"flushroutes": true, "onprotected": "skip", "protectedroutesfile": "` + confFile + `",`)
+		Expect(conf.loadRoutesFiles()).To(Succeed())
+		Expect(testRouteStrings(conf.ProtectedRoutes)).To(Equal([]string{"10.96.0.0/12", "30.0.0.0/24 via 10.0.0.1"}))
+
+		plan, err := planRoutes(conf, []string{"dummy0"}, routes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"delete default via 10.0.0.1 dev dummy0",
+		}))
+
+		Expect(os.WriteFile(confFile, []byte(`["{{.Subnet4}}"]`), 0644)).To(Succeed())
+		conf = testConf(`"protectedroutesfile": "` + confFile + `",`)
+		Expect(conf.loadRoutesFiles()).To(MatchError(ContainSubstring("cannot be a template or have conditions")))
+	})
+
+	It("rejects null protected routes", func() {
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"protectedroutes": ["10.96.0.0/12", null]
+		}`), "")
+		Expect(err).To(MatchError("protectedroutes[1]: missing route"))
+	})
+
+	It("tears down a pod whose protectedroutesfile cannot be read", func() {
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+		runDir, err := os.MkdirTemp("", "route-override-protected")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(runDir)
+
+		Expect(cmdDel(&skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "dummy0",
+			StdinData: []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"cniVersion": "0.3.1",
+				"rundir": "` + runDir + `",
+				"protectedroutesfile": "` + filepath.Join(runDir, "missing") + `"
+			}`),
+		})).To(Succeed())
+	})
+})
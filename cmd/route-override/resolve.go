@@ -0,0 +1,152 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// resolve returns the route entry for the interface of the route, or for
+// ifName if the route has no device: its template is executed and nil is
+// returned if its conditions do not hold
+func (r *RouteEntry) resolve(res *current.Result, args *CNIArgs, ifName string) (*RouteEntry, error) {
+	entry, err := r.resolveTemplate(res, ifName)
+	if err != nil {
+		return nil, err
+	}
+	if entry.When == nil {
+		return entry, nil
+	}
+	if entry.Dev != "" {
+		ifName = entry.Dev
+	}
+	if res == nil || !entry.When.holds(routeWhenContext(res, args, ifName)) {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// resolveRoutes resolves the route entries, leaving out those whose
+// conditions do not hold
+func resolveRoutes(entries []*RouteEntry, res *current.Result, args *CNIArgs, ifName string) ([]*RouteEntry, error) {
+	if entries == nil {
+		return nil, nil
+	}
+	resolved := make([]*RouteEntry, 0, len(entries))
+	for _, entry := range entries {
+		r, err := entry.resolve(res, args, ifName)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			resolved = append(resolved, r)
+		}
+	}
+	return resolved, nil
+}
+
+// needsResolve returns true if any route entry of the configuration is a
+// template or has conditions
+func (conf *RouteOverrideConfig) needsResolve() bool {
+	lists := [][]*RouteEntry{conf.DelRoutes, conf.AddRoutes, conf.KeepRoutes, conf.Routes}
+	for _, ifConf := range conf.Interfaces {
+		lists = append(lists, ifConf.DelRoutes, ifConf.AddRoutes, ifConf.KeepRoutes)
+	}
+	for _, step := range conf.Operations {
+		if step.Route != nil {
+			lists = append(lists, []*RouteEntry{step.Route})
+		}
+	}
+	for _, list := range lists {
+		for _, entry := range list {
+			if entry.template != "" || entry.When != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolve returns the configuration with the route entries resolved for
+// the container interfaces. Routes of an interfaces entry are resolved for
+// each interface the entry applies to, and top-level delroutes and
+// keeproutes for each interface; other routes are resolved for the first
+// interface, unless they name a device. Steps whose route does not apply
+// are left out.
+func (conf *RouteOverrideConfig) resolve(ifNames []string) (*RouteOverrideConfig, error) {
+	if !conf.needsResolve() {
+		return conf, nil
+	}
+	resolved := *conf
+	res, args := conf.PrevResult, conf.cniArgs
+	var err error
+	if resolved.AddRoutes, err = resolveRoutes(conf.AddRoutes, res, args, ifNames[0]); err != nil {
+		return nil, err
+	}
+	if resolved.DelRoutes, err = resolveRoutes(conf.DelRoutes, res, args, ifNames[0]); err != nil {
+		return nil, err
+	}
+	if resolved.KeepRoutes, err = resolveRoutes(conf.KeepRoutes, res, args, ifNames[0]); err != nil {
+		return nil, err
+	}
+	if resolved.Routes, err = resolveRoutes(conf.Routes, res, args, ifNames[0]); err != nil {
+		return nil, err
+	}
+
+	if conf.Operations != nil {
+		resolved.Operations = make([]*routeStep, 0, len(conf.Operations))
+		for _, step := range conf.Operations {
+			s := *step
+			if step.Route != nil {
+				if s.Route, err = step.Route.resolve(res, args, ifNames[0]); err != nil {
+					return nil, err
+				}
+				if s.Route == nil {
+					continue
+				}
+			}
+			resolved.Operations = append(resolved.Operations, &s)
+		}
+	}
+
+	// every interface gets an entry of its own, which takes precedence
+	// over the globs
+	if conf.Routes == nil && conf.Operations == nil {
+		resolved.Interfaces = map[string]*InterfaceConfig{}
+		for _, name := range ifNames {
+			ifConf := &InterfaceConfig{}
+			if c := conf.interfaceConfig(name); c != nil {
+				*ifConf = *c
+			}
+			if ifConf.DelRoutes == nil {
+				ifConf.DelRoutes = conf.DelRoutes
+			}
+			if ifConf.KeepRoutes == nil {
+				ifConf.KeepRoutes = conf.KeepRoutes
+			}
+			if ifConf.DelRoutes, err = resolveRoutes(ifConf.DelRoutes, res, args, name); err != nil {
+				return nil, err
+			}
+			if ifConf.AddRoutes, err = resolveRoutes(ifConf.AddRoutes, res, args, name); err != nil {
+				return nil, err
+			}
+			if ifConf.KeepRoutes, err = resolveRoutes(ifConf.KeepRoutes, res, args, name); err != nil {
+				return nil, err
+			}
+			resolved.Interfaces[name] = ifConf
+		}
+	}
+	return &resolved, nil
+}
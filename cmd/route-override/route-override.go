@@ -18,11 +18,14 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -37,30 +40,72 @@ import (
 // + only checko route/dst
 //go build ./cmd/route-override/
 
+const (
+	// modeReplace installs addroutes with replace semantics so that a
+	// repeated ADD converges to the same routing table
+	modeReplace = "replace"
+	// modeAdd installs addroutes strictly and fails on conflicting routes
+	modeAdd = "add"
+)
+
 // RouteOverrideConfig represents the network route-override configuration
 type RouteOverrideConfig struct {
 	types.NetConf
 
 	PrevResult *current.Result `json:"-"`
 
-	FlushRoutes  bool           `json:"flushroutes,omitempty"`
-	FlushGateway bool           `json:"flushgateway,omitempty"`
-	DelRoutes    []*types.Route `json:"delroutes"`
-	AddRoutes    []*types.Route `json:"addroutes"`
-	SkipCheck    bool           `json:"skipcheck,omitempty"`
+	// cniArgs are the parsed CNI_ARGS, for the conditions of route entries
+	cniArgs *CNIArgs
+
+	FlushRoutes         bool                                  `json:"flushroutes,omitempty"`
+	FlushGateway        bool                                  `json:"flushgateway,omitempty"`
+	DelRoutes           []*RouteEntry                         `json:"delroutes"`
+	AddRoutes           []*RouteEntry                         `json:"addroutes"`
+	SkipCheck           bool                                  `json:"skipcheck,omitempty"`
+	Mode                string                                `json:"mode,omitempty"`
+	DryRun              bool                                  `json:"dryrun,omitempty"`
+	RunDir              string                                `json:"rundir,omitempty"`
+	LockTimeout         int                                   `json:"locktimeout,omitempty"`
+	Routes              []*RouteEntry                         `json:"routes,omitempty"`
+	Operations          []*routeStep                          `json:"operations,omitempty"`
+	DefaultRoute        *DefaultRouteConfig                   `json:"defaultroute,omitempty"`
+	KeepRoutes          []*RouteEntry                         `json:"keeproutes,omitempty"`
+	Rules               []*kernelRule                         `json:"rules,omitempty"`
+	Interfaces          map[string]*InterfaceConfig           `json:"interfaces,omitempty"`
+	Profiles            map[string]map[string]json.RawMessage `json:"profiles,omitempty"`
+	RoutesFile          string                                `json:"routesfile,omitempty"`
+	DelRoutesFile       string                                `json:"delroutesfile,omitempty"`
+	ProtectedRoutes     []*RouteEntry                         `json:"protectedroutes,omitempty"`
+	ProtectedRoutesFile string                                `json:"protectedroutesfile,omitempty"`
+	OnProtected         string                                `json:"onprotected,omitempty"`
+	ArgsMerge           string                                `json:"argsmerge,omitempty"`
+	ArgsAllow           *ArgsAllowConfig                      `json:"argsallow,omitempty"`
+	Locked              []string                              `json:"locked,omitempty"`
+	Strict              *bool                                 `json:"strict,omitempty"`
+	AcceptRA            *AcceptRAConfig                       `json:"acceptra,omitempty"`
 
 	Args *struct {
 		A *IPAMArgs `json:"cni"`
 	} `json:"args"`
+
+	// RuntimeConfig holds the routeOverride capability, which takes the
+	// same keys as args
+	RuntimeConfig *struct {
+		RouteOverride *IPAMArgs `json:"routeOverride,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
 }
 
 // IPAMArgs represents CNI argument conventions for the plugin
 type IPAMArgs struct {
-	FlushRoutes  *bool          `json:"flushroutes,omitempty"`
-	FlushGateway *bool          `json:"flushgateway,omitempty"`
-	DelRoutes    []*types.Route `json:"delroutes,omitempty"`
-	AddRoutes    []*types.Route `json:"addroutes,omitempty"`
-	SkipCheck    *bool          `json:"skipcheck,omitempty"`
+	FlushRoutes  *bool         `json:"flushroutes,omitempty"`
+	FlushGateway *bool         `json:"flushgateway,omitempty"`
+	DelRoutes    []*RouteEntry `json:"delroutes,omitempty"`
+	AddRoutes    []*RouteEntry `json:"addroutes,omitempty"`
+	Routes       []*RouteEntry `json:"routes,omitempty"`
+	KeepRoutes   []*RouteEntry `json:"keeproutes,omitempty"`
+	Rules        []*kernelRule `json:"rules,omitempty"`
+	SkipCheck    *bool         `json:"skipcheck,omitempty"`
+	DryRun       *bool         `json:"dryrun,omitempty"`
 }
 
 /*
@@ -68,35 +113,128 @@ type IPAMArgs struct {
 		types.CommonArgs
 	}
 */
-func parseConf(data []byte, _ string) (*RouteOverrideConfig, error) {
+func parseConf(data []byte, envArgs string) (*RouteOverrideConfig, error) {
 	conf := RouteOverrideConfig{FlushRoutes: false}
 
+	args := parseCNIArgs(envArgs)
+	// the profile of the pod overrides the top-level keys
+	data, err := applyProfile(data, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
 	if err := json.Unmarshal(data, &conf); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
+	conf.cniArgs = args
+
+	switch conf.Mode {
+	case "":
+		conf.Mode = modeReplace
+	case modeReplace, modeAdd:
+	default:
+		return nil, fmt.Errorf("invalid mode %q: must be %q or %q", conf.Mode, modeAdd, modeReplace)
+	}
 
-	// override values by args
-	if conf.Args != nil {
-		if conf.Args.A.FlushRoutes != nil {
-			conf.FlushRoutes = *conf.Args.A.FlushRoutes
-		}
+	switch conf.OnProtected {
+	case "":
+		conf.OnProtected = onProtectedFail
+	case onProtectedFail, onProtectedSkip:
+	default:
+		return nil, fmt.Errorf("invalid onprotected %q: must be %q or %q", conf.OnProtected, onProtectedFail, onProtectedSkip)
+	}
+	if err := validateProtectedRoutes(conf.ProtectedRoutes); err != nil {
+		return nil, err
+	}
 
-		if conf.Args.A.FlushGateway != nil {
-			conf.FlushGateway = *conf.Args.A.FlushGateway
+	for _, l := range []struct {
+		key     string
+		entries []*RouteEntry
+	}{
+		{"delroutes", conf.DelRoutes},
+		{"addroutes", conf.AddRoutes},
+		{"routes", conf.Routes},
+		{"keeproutes", conf.KeepRoutes},
+	} {
+		if err := nullRoute(l.key, l.entries); err != nil {
+			return nil, err
 		}
+	}
+	for i, rule := range conf.Rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rules[%d]: missing rule", i)
+		}
+	}
+
+	if conf.RunDir == "" {
+		conf.RunDir = defaultRunDir
+	}
+	if conf.LockTimeout < 0 {
+		return nil, fmt.Errorf("invalid locktimeout %d: must not be negative", conf.LockTimeout)
+	} else if conf.LockTimeout == 0 {
+		conf.LockTimeout = defaultLockTimeout
+	}
+
+	// override values by args
+	if err := conf.applyArgs(); err != nil {
+		return nil, err
+	}
+
+	// the desired state replaces the flush, delete and add sequence
+	if conf.Routes != nil && (conf.FlushRoutes || conf.FlushGateway ||
+		conf.DelRoutes != nil || conf.AddRoutes != nil ||
+		conf.RoutesFile != "" || conf.DelRoutesFile != "") {
+		return nil, fmt.Errorf("routes cannot be combined with flushroutes, flushgateway, delroutes, addroutes, routesfile or delroutesfile")
+	}
 
-		if conf.Args.A.DelRoutes != nil {
-			conf.DelRoutes = conf.Args.A.DelRoutes
+	if conf.AcceptRA != nil {
+		if err := conf.AcceptRA.validate(); err != nil {
+			return nil, err
 		}
+	}
 
-		if conf.Args.A.AddRoutes != nil {
-			conf.AddRoutes = conf.Args.A.AddRoutes
+	for key, ifConf := range conf.Interfaces {
+		if ifConf == nil {
+			return nil, fmt.Errorf("interfaces[%q]: missing settings", key)
+		}
+		// only acceptra applies to every mode
+		if ifConf.hasRoutes() && (conf.Routes != nil || conf.Operations != nil) {
+			return nil, fmt.Errorf("interfaces cannot be combined with routes or operations")
 		}
+		if _, err := filepath.Match(key, ""); err != nil {
+			return nil, fmt.Errorf("interfaces[%q]: invalid glob: %v", key, err)
+		}
+		if ifConf.AcceptRA != nil {
+			if err := ifConf.AcceptRA.validate(); err != nil {
+				return nil, fmt.Errorf("interfaces[%q]: %v", key, err)
+			}
+		}
+	}
 
-		if conf.Args.A.SkipCheck != nil {
-			conf.SkipCheck = *conf.Args.A.SkipCheck
+	if conf.DefaultRoute != nil {
+		if conf.FlushGateway || conf.Routes != nil || conf.Operations != nil {
+			return nil, fmt.Errorf("defaultroute cannot be combined with flushgateway, routes or operations")
+		}
+		if err := conf.DefaultRoute.validate(); err != nil {
+			return nil, err
 		}
+	}
 
+	// the pipeline replaces the fixed sequence as well
+	if conf.Operations != nil {
+		if conf.Routes != nil || conf.FlushRoutes || conf.FlushGateway ||
+			conf.DelRoutes != nil || conf.AddRoutes != nil ||
+			conf.RoutesFile != "" || conf.DelRoutesFile != "" {
+			return nil, fmt.Errorf("operations cannot be combined with routes, flushroutes, flushgateway, delroutes, addroutes, routesfile or delroutesfile")
+		}
+		for i, step := range conf.Operations {
+			if step == nil {
+				return nil, fmt.Errorf("operations[%d]: missing op", i)
+			}
+			if err := step.validate(); err != nil {
+				return nil, fmt.Errorf("operations[%d]: %v", i, err)
+			}
+		}
 	}
 
 	// Parse previous result
@@ -106,216 +244,316 @@ func parseConf(data []byte, _ string) (*RouteOverrideConfig, error) {
 			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
 		}
 
-		res, err := version.NewResult(conf.CNIVersion, resultBytes)
-
-		if err != nil {
-			return nil, fmt.Errorf("could not parse prevResult: %v", err)
-		}
-
 		conf.RawPrevResult = nil
-		conf.PrevResult, err = current.NewResultFromResult(res)
+		conf.PrevResult, err = parsePrevResult(conf.CNIVersion, resultBytes)
 		if err != nil {
-			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+			return nil, err
 		}
 	}
 
 	return &conf, nil
 }
 
-func deleteAllRoutes(res *current.Result) error {
-	var err error
-	for _, netif := range res.Interfaces {
-		if netif.Sandbox != "" {
-			link, _ := netlink.LinkByName(netif.Name)
-			routes, _ := netlink.RouteList(link, netlink.FAMILY_ALL)
-			for _, route := range routes {
-				if route.Scope != netlink.SCOPE_LINK {
-					if route.Dst != nil {
-						if route.Dst.IP.IsLinkLocalUnicast() != true && route.Gw != nil {
-							err = netlink.RouteDel(&route)
-						}
-					} else {
-						err = netlink.RouteDel(&route)
-					}
-				}
-			}
-		}
+// parsePrevResult parses the previous result and converts it to the
+// current version
+func parsePrevResult(cniVersion string, data []byte) (*current.Result, error) {
+	res, err := version.NewResult(cniVersion, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse prevResult: %v", err)
 	}
 
-	return err
+	prevResult, err := current.NewResultFromResult(res)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	return prevResult, nil
 }
 
-func deleteGWRoute(res *current.Result) error {
-	var err error
-	// fallback to eth0 if there is no interface in result
-	if res.Interfaces == nil {
-		link, _ := netlink.LinkByName("eth0")
-		routes, _ := netlink.RouteList(link, netlink.FAMILY_ALL)
-		for _, nlroute := range routes {
-			if nlroute.Dst == nil {
-				err = netlink.RouteDel(&nlroute)
-			}
-		}
-	} else {
-		for _, netif := range res.Interfaces {
-			if netif.Sandbox != "" {
-				link, _ := netlink.LinkByName(netif.Name)
-				routes, _ := netlink.RouteList(link, netlink.FAMILY_ALL)
-				for _, nlroute := range routes {
-					if nlroute.Dst == nil {
-						err = netlink.RouteDel(&nlroute)
-					}
-				}
-			}
-		}
+// recoverJournal settles the journal of an interrupted ADD, if any, by
+// finishing or rolling back its operations in the current netns. A dry run
+// only reports the operations and leaves the journal in place.
+func recoverJournal(k *kernel, conf *RouteOverrideConfig, args *skel.CmdArgs, rollback bool) error {
+	j, err := loadJournal(conf.RunDir, args.ContainerID, args.IfName)
+	if err != nil || j == nil {
+		return err
 	}
 
-	return err
-}
-
-func deleteRoute(route *types.Route, res *current.Result) error {
-	var err error
-	// fallback to eth0 if there is no interface in result
-	if res.Interfaces == nil {
-		link, _ := netlink.LinkByName("eth0")
-		routes, _ := netlink.RouteList(link, netlink.FAMILY_ALL)
-		for _, nlroute := range routes {
-			if nlroute.Dst != nil &&
-				nlroute.Dst.IP.Equal(route.Dst.IP) &&
-				nlroute.Dst.Mask.String() == route.Dst.Mask.String() {
-				err = netlink.RouteDel(&nlroute)
+	if conf.DryRun {
+		if rollback {
+			for _, op := range j.rollbackOperations() {
+				fmt.Fprintf(os.Stderr, "route-override: dry run: roll back %v\n", op)
 			}
+			return nil
 		}
-	} else {
-		for _, netif := range res.Interfaces {
-			if netif.Sandbox != "" {
-				link, _ := netlink.LinkByName(netif.Name)
-				routes, _ := netlink.RouteList(link, netlink.FAMILY_ALL)
-				for _, nlroute := range routes {
-					if nlroute.Dst != nil &&
-						nlroute.Dst.IP.Equal(route.Dst.IP) &&
-						nlroute.Dst.Mask.String() == route.Dst.Mask.String() {
-						err = netlink.RouteDel(&nlroute)
-					}
-				}
+		for _, op := range j.Operations {
+			if !op.Done {
+				fmt.Fprintf(os.Stderr, "route-override: dry run: finish %v\n", op)
 			}
 		}
+		return nil
 	}
 
-	return err
+	if rollback {
+		fmt.Fprintf(os.Stderr, "route-override: rolling back %d operations of interrupted ADD\n", len(j.rollbackOperations()))
+		return j.rollback(k)
+	}
+	fmt.Fprintf(os.Stderr, "route-override: finishing %d operations of interrupted ADD\n", j.pending())
+	return j.finish(k)
 }
 
-func addRoute(dev netlink.Link, route *types.Route) error {
-	return netlink.RouteAdd(&netlink.Route{
-		LinkIndex: dev.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
-		Dst:       &route.Dst,
-		Gw:        route.GW,
-	})
+// withKernel runs f with a kernel handle opened in the current netns
+func withKernel(f func(k *kernel) error) error {
+	k, err := newKernel()
+	if err != nil {
+		return err
+	}
+	defer k.close()
+	return f(k)
 }
 
-func processRoutes(netnsname string, conf *RouteOverrideConfig) (*current.Result, error) {
-	netns, err := ns.GetNS(netnsname)
+// removeOwnedRoutes deletes the desired routes on DEL
+func removeOwnedRoutes(k *kernel, conf *RouteOverrideConfig, ifName string) error {
+	ifNames, err := containerIfNames(conf.PrevResult, ifName, k)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return err
 	}
-	defer netns.Close()
-
-	res, err := current.NewResultFromResult(conf.PrevResult)
+	routes, err := k.dumpRoutes()
 	if err != nil {
-		return nil, fmt.Errorf("could not convert result to current version: %v", err)
+		return err
 	}
+	if conf, err = conf.resolve(ifNames); err != nil {
+		return err
+	}
+	for _, op := range planOwnedRoutes(conf, ifNames, routes) {
+		if conf.protectedRoute(op.Route) != nil {
+			fmt.Fprintf(os.Stderr, "route-override: skipping %v: the route is protected\n", op)
+			continue
+		}
+		if conf.DryRun {
+			fmt.Fprintf(os.Stderr, "route-override: dry run: %v\n", op)
+			continue
+		}
+		if err := k.apply(op); err != nil {
+			fmt.Fprintf(os.Stderr, "route-override: failed to %v: %v\n", op, err)
+		}
+	}
+	return nil
+}
 
-	if conf.FlushGateway {
-		// add "0.0.0.0/0" into delRoute to remove it from routing table/result
-		_, gwRoute, _ := net.ParseCIDR("0.0.0.0/0")
-		conf.DelRoutes = append(conf.DelRoutes, &types.Route{Dst: *gwRoute})
-		_, gwRoute, _ = net.ParseCIDR("::/0")
-		conf.DelRoutes = append(conf.DelRoutes, &types.Route{Dst: *gwRoute})
-
-		// delete given gateway address
-		for _, ips := range res.IPs {
-			if ips.Address.IP.To4() == nil {
-				ips.Gateway = net.IPv6zero
-			} else {
-				ips.Gateway = net.IPv4zero
-			}
+// checkDesiredRoutes returns an error listing the operations needed to
+// reach the desired routes, if any
+func checkDesiredRoutes(k *kernel, conf *RouteOverrideConfig, ifNames []string) error {
+	routes, err := k.dumpRoutes()
+	if err != nil {
+		return err
+	}
+	diff := []string{}
+	for _, op := range uniqueOperations(planDesiredRoutes(conf, ifNames, routes)) {
+		// ADD leaves protected routes in place
+		if op.Action == opDelete && conf.protectedRoute(op.Route) != nil {
+			continue
 		}
+		diff = append(diff, op.String())
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	return fmt.Errorf("route-override: routes differ from the desired state: %s", strings.Join(diff, "; "))
+}
+
+func processRoutes(args *skel.CmdArgs, conf *RouteOverrideConfig) (*current.Result, error) {
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
+	defer netns.Close()
 
-	newRoutes := []*types.Route{}
+	var plan *routePlan
 	err = netns.Do(func(_ ns.NetNS) error {
-		// Flush route if required
-		if !conf.FlushRoutes {
-		NEXT:
-			for _, route := range res.Routes {
-				for _, delroute := range conf.DelRoutes {
-					if route.Dst.IP.Equal(delroute.Dst.IP) &&
-						bytes.Equal(route.Dst.Mask, delroute.Dst.Mask) {
-						err = deleteRoute(delroute, res)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "failed to delete route %v: %v", delroute, err)
-						}
-						continue NEXT
-					}
+		return withKernel(func(k *kernel) error {
+			if err := recoverJournal(k, conf, args, false); err != nil {
+				return err
+			}
+
+			ifNames, err := containerIfNames(conf.PrevResult, args.IfName, k)
+			if err != nil {
+				return err
+			}
 
+			// RAs must not re-add the routes that are about to be removed
+			sysctls := conf.acceptRASysctls(ifNames)
+			if conf.DryRun {
+				for _, change := range sysctlChanges(sysctls) {
+					fmt.Fprintf(os.Stderr, "route-override: dry run: %s\n", change)
 				}
-				newRoutes = append(newRoutes, route)
+			} else if err := applyAcceptRA(sysctls, conf.RunDir, args.ContainerID, args.IfName); err != nil {
+				return err
 			}
-		} else {
-			deleteAllRoutes(res)
-		}
 
-		if conf.FlushGateway {
-			deleteGWRoute(res)
-		}
+			routes, err := k.dumpRoutes()
+			if err != nil {
+				return err
+			}
 
-		// Get container IF name
-		var containerIFName string
-		for _, i := range res.Interfaces {
-			if i.Sandbox != "" {
-				containerIFName = i.Name
-				break
+			plan, err = planRoutes(conf, ifNames, routes)
+			if err != nil {
+				return err
 			}
-		}
-		// Add route
-		dev, _ := netlink.LinkByName(containerIFName)
-		for _, route := range conf.AddRoutes {
-			newRoutes = append(newRoutes, route)
-			if err := addRoute(dev, route); err != nil {
-				fmt.Fprintf(os.Stderr, "failed to add route: %v: %v", route, err)
+			for _, warning := range plan.Warnings {
+				fmt.Fprintf(os.Stderr, "route-override: %s\n", warning)
 			}
-		}
 
-		return nil
+			if conf.DryRun {
+				for _, op := range plan.Operations {
+					fmt.Fprintf(os.Stderr, "route-override: dry run: %v\n", op)
+				}
+				return nil
+			}
+
+			// record the operations before touching the routing table
+			j := newJournal(conf.RunDir, args.ContainerID, args.IfName)
+			j.Operations = plan.Operations
+			return j.apply(k, func(op *routeOperation, err error) error {
+				// in add mode, a conflicting route is reported to the runtime
+				if op.Action == opAdd {
+					return fmt.Errorf("failed to %v: %v", op, err)
+				}
+				fmt.Fprintf(os.Stderr, "route-override: failed to %v: %v\n", op, err)
+				return nil
+			})
+		})
 	})
-	res.Routes = newRoutes
+	if err != nil {
+		return nil, err
+	}
 
-	return res, nil
+	return plan.Result, nil
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+// addResult runs ADD and returns its result in the CNI version of the
+// configuration
+func addResult(args *skel.CmdArgs) (types.Result, error) {
+	if err := validateConf(args.StdinData, args.Args); err != nil {
+		return nil, err
+	}
 	overrideConf, err := parseConf(args.StdinData, args.Args)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := overrideConf.loadRoutesFiles(); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockNetnsForConf(overrideConf, args.ContainerID, args.Netns)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	newResult, err := processRoutes(args, overrideConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to override routes: %v", err)
 	}
 
-	newResult, err := processRoutes(args.Netns, overrideConf)
+	return newResult.GetAsVersion(overrideConf.CNIVersion)
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	result, err := addResult(args)
 	if err != nil {
-		return fmt.Errorf("failed to override routes: %v", err)
+		return err
 	}
+	return result.Print()
+}
 
-	return types.PrintResult(newResult, overrideConf.CNIVersion)
+// parseDelConf parses the configuration for DEL, which does not fail on an
+// invalid configuration, so that a pod can always be torn down. It falls
+// back to the rundir, locktimeout and dryrun keys, which are enough to roll
+// back an interrupted ADD and to remove the state of the pod.
+func parseDelConf(args *skel.CmdArgs) *RouteOverrideConfig {
+	conf, err := parseConf(args.StdinData, args.Args)
+	if err == nil {
+		return conf
+	}
+	fmt.Fprintf(os.Stderr, "route-override: ignoring the configuration on DEL: %v\n", err)
+
+	conf = &RouteOverrideConfig{}
+	fallback := struct {
+		RunDir      string `json:"rundir"`
+		LockTimeout int    `json:"locktimeout"`
+		DryRun      bool   `json:"dryrun"`
+	}{}
+	_ = json.Unmarshal(args.StdinData, &fallback)
+	conf.RunDir = fallback.RunDir
+	if conf.RunDir == "" {
+		conf.RunDir = defaultRunDir
+	}
+	conf.LockTimeout = fallback.LockTimeout
+	if conf.LockTimeout <= 0 {
+		conf.LockTimeout = defaultLockTimeout
+	}
+	conf.DryRun = fallback.DryRun
+	return conf
 }
 
-func cmdDel(_ *skel.CmdArgs) error {
-	// TODO: the settings are not reverted to the previous values. Reverting the
-	// settings is not useful when the whole container goes away but it could be
+func cmdDel(args *skel.CmdArgs) error {
+	// nothing to serialize against or roll back if the netns is already gone
+	netnsGone := args.Netns == ""
+	if !netnsGone {
+		_, err := os.Stat(args.Netns)
+		netnsGone = err != nil
+	}
+	overrideConf := parseDelConf(args)
+	if netnsGone {
+		if err := newAcceptRAState(overrideConf.RunDir, args.ContainerID, args.IfName).remove(); err != nil {
+			return err
+		}
+		if err := newJournal(overrideConf.RunDir, args.ContainerID, args.IfName).remove(); err != nil {
+			return err
+		}
+		return removeNetnsLocks(overrideConf.RunDir, args.ContainerID)
+	}
+	// DEL only removes routes that ADD installed, so the protected routes
+	// are a safeguard that must not keep the pod from being torn down
+	if err := overrideConf.loadProtectedRoutes(); err != nil {
+		fmt.Fprintf(os.Stderr, "route-override: ignoring protected routes files: %v\n", err)
+	}
+
+	lock, err := lockNetnsForConf(overrideConf, args.ContainerID, args.Netns)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "route-override: continuing DEL without the netns lock: %v\n", err)
+	}
+	defer lock.Unlock()
+
+	// roll back an interrupted ADD
+	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		return withKernel(func(k *kernel) error {
+			if err := recoverJournal(k, overrideConf, args, true); err != nil {
+				return err
+			}
+			if err := restoreAcceptRA(overrideConf.RunDir, args.ContainerID, args.IfName, overrideConf.DryRun); err != nil {
+				return err
+			}
+			if overrideConf.Routes == nil {
+				return nil
+			}
+			return removeOwnedRoutes(k, overrideConf, args.IfName)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// TODO: the routes are not reverted to the previous values. Reverting the
+	// routes is not useful when the whole container goes away but it could be
 	// useful in scenarios where plugins are added and removed at runtime.
 	return nil
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
+	if err := validateConf(args.StdinData, args.Args); err != nil {
+		return err
+	}
 	// Parse previous result
 	overrideConf, err := parseConf(args.StdinData, args.Args)
 
@@ -327,6 +565,9 @@ func cmdCheck(args *skel.CmdArgs) error {
 	if overrideConf.SkipCheck == true {
 		return nil
 	}
+	if err := overrideConf.loadRoutesFiles(); err != nil {
+		return err
+	}
 
 	if overrideConf.PrevResult == nil {
 		return fmt.Errorf("Required prevResult missing")
@@ -346,7 +587,44 @@ func cmdCheck(args *skel.CmdArgs) error {
 		gateways = append(gateways, i.Gateway)
 	}
 
+	lock, err := lockNetnsForConf(overrideConf, args.ContainerID, args.Netns)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		// the default routes of the container interfaces are checked
+		ifIndexes := map[int]bool{}
+		var linkLocalLinks map[string]int
+		err := withKernel(func(k *kernel) error {
+			// finish an interrupted ADD before checking its outcome
+			if err := recoverJournal(k, overrideConf, args, false); err != nil {
+				return err
+			}
+
+			ifNames, err := containerIfNames(overrideConf.PrevResult, args.IfName, k)
+			if err != nil {
+				return err
+			}
+			for _, name := range ifNames {
+				ifIndexes[k.linkIndex[name]] = true
+			}
+			if overrideConf, err = overrideConf.resolve(ifNames); err != nil {
+				return err
+			}
+			linkLocalLinks = linkLocalRouteLinks(k, overrideConf)
+
+			// in desired state mode, any difference is reported
+			if overrideConf.Routes != nil {
+				return checkDesiredRoutes(k, overrideConf, ifNames)
+			}
+			return nil
+		})
+		if err != nil || overrideConf.Routes != nil {
+			return err
+		}
+
 		for _, cniRoute := range overrideConf.DelRoutes {
 			_, err := netlink.RouteGet(cniRoute.Dst.IP)
 			if err == nil {
@@ -355,6 +633,14 @@ func cmdCheck(args *skel.CmdArgs) error {
 		}
 
 		for _, cniRoute := range result.Routes {
+			// the kernel may pick a route on another interface
+			if isLinkLocalGW(cniRoute.GW) {
+				if err := checkLinkLocalRoute(cniRoute, linkLocalLinks, ifIndexes); err != nil {
+					return err
+				}
+				continue
+			}
+
 			var routes []netlink.Route
 			if cniRoute.Dst.IP.Equal(net.ParseIP("0.0.0.0")) == true || cniRoute.Dst.IP.Equal(net.ParseIP("::")) {
 				family := netlink.FAMILY_ALL
@@ -366,10 +652,15 @@ func cmdCheck(args *skel.CmdArgs) error {
 				filter := &netlink.Route{
 					Dst: nil,
 				}
-				routes, err = netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_DST)
+				defaultRoutes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_DST)
 				if err != nil {
 					return err
 				}
+				for _, route := range defaultRoutes {
+					if ifIndexes[route.LinkIndex] {
+						routes = append(routes, route)
+					}
+				}
 			} else {
 				routes, err = netlink.RouteGet(cniRoute.Dst.IP)
 				if err != nil {
@@ -404,7 +695,76 @@ func cmdCheck(args *skel.CmdArgs) error {
 	return err
 }
 
+// linkLocalRouteKey identifies a route via a link-local gateway
+func linkLocalRouteKey(dst *net.IPNet, gw net.IP) string {
+	return dstKey(dst) + " via " + gw.String()
+}
+
+// linkLocalRouteLinks returns the link indexes of the devices of the
+// configured routes via link-local gateways. Routes without a device are
+// installed on a container interface, and are left out.
+func linkLocalRouteLinks(k *kernel, conf *RouteOverrideConfig) map[string]int {
+	entries := append([]*RouteEntry{}, conf.AddRoutes...)
+	for _, ifConf := range conf.Interfaces {
+		entries = append(entries, ifConf.AddRoutes...)
+	}
+	for _, step := range conf.Operations {
+		if step.Route != nil && step.Op != stepDelete {
+			entries = append(entries, step.Route)
+		}
+	}
+
+	links := map[string]int{}
+	for _, entry := range entries {
+		if isLinkLocalGW(entry.GW) && entry.Dev != "" && entry.table() == syscall.RT_TABLE_MAIN {
+			links[linkLocalRouteKey(&entry.Dst, entry.GW)] = k.linkIndex[entry.Dev]
+		}
+	}
+	return links
+}
+
+// checkLinkLocalRoute checks that a result route via a link-local gateway
+// is on the device it was configured on, or else on a container interface
+func checkLinkLocalRoute(cniRoute *types.Route, links map[string]int, ifIndexes map[int]bool) error {
+	want := ifIndexes
+	if index, ok := links[linkLocalRouteKey(&cniRoute.Dst, cniRoute.GW)]; ok {
+		want = map[int]bool{index: true}
+	}
+
+	filter := &netlink.Route{Gw: cniRoute.GW}
+	if ones, _ := cniRoute.Dst.Mask.Size(); ones > 0 {
+		filter.Dst = &cniRoute.Dst
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, filter, netlink.RT_FILTER_DST|netlink.RT_FILTER_GW)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if want[route.LinkIndex] {
+			return nil
+		}
+	}
+	return fmt.Errorf("route-override: route %v via %v is not on its interface", cniRoute.Dst.String(), cniRoute.GW)
+}
+
 func main() {
+	// tools are selected by subcommand, since the runtime never passes
+	// arguments to the plugin
+	if len(os.Args) > 1 {
+		tools := map[string]func([]string, io.Writer) error{
+			"simulate": runSimulate,
+			"debug":    runDebug,
+			"schema":   runSchema,
+		}
+		if tool, ok := tools[os.Args[1]]; ok {
+			if err := tool(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "route-override %s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// TODO: implement plugin version
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "TODO")
 }
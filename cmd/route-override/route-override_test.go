@@ -18,8 +18,9 @@ package main
 //revive:disable:dot-imports
 import (
 	//"fmt"
-	//"os"
+	"encoding/json"
 	"net"
+	"os"
 	"testing"
 
 	"github.com/containernetworking/cni/pkg/skel"
@@ -78,10 +79,14 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 	const IFNAME string = "dummy0"
 	var originalNS ns.NetNS
 	var targetNS ns.NetNS
+	var runDir string
 
 	BeforeEach(func() {
 		// Create a new NetNS so we don't modify the host
 		var err error
+		runDir, err = os.MkdirTemp("", "route-override-conf")
+		Expect(err).NotTo(HaveOccurred())
+
 		originalNS, err = testutils.NewNS()
 		Expect(err).NotTo(HaveOccurred())
 
@@ -107,6 +112,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 
 	AfterEach(func() {
 		Expect(originalNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(runDir)).To(Succeed())
 	})
 
 	Context("ipv4 route manipulation", func() {
@@ -114,6 +120,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"prevResult": {
 					"cniVersion": "0.3.1",
@@ -230,6 +237,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"flushroutes": true,
 				"prevResult": {
@@ -345,6 +353,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"flushgateway": true,
 				"prevResult": {
@@ -459,6 +468,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"delroutes": [ { "dst": "20.0.0.0/24" } ],
 				"prevResult": {
@@ -576,6 +586,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"addroutes": [
 				{
@@ -688,6 +699,274 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 
+		It("re-running ADD with addroutes converges", func() {
+			conf := []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"rundir": "` + runDir + `",
+				"cniVersion": "0.3.1",
+				"addroutes": [
+				{
+					"dst": "20.0.0.0/24",
+					"gw": "10.0.0.254"
+				}],
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [
+					{
+						"name": "dummy0", "sandbox":"netns"
+					}],
+					"ips": [
+					{
+						"version": "4",
+						"address": "10.0.0.2/24",
+						"gateway": "10.0.0.1",
+						"interface": 0
+					}],
+					"routes": [
+					{
+						"dst": "0.0.0.0/0"
+					}]
+				}
+			}`)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   conf,
+			}
+
+			// set address/route as fakeCNI plugin
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				err = netlink.LinkSetUp(link)
+				Expect(err).NotTo(HaveOccurred())
+
+				// addr 10.0.0.2/24
+				err = testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))
+				Expect(err).NotTo(HaveOccurred())
+
+				// add default gateway into IFNAME
+				err = testAddRoute(link,
+					net.IPv4(0, 0, 0, 0), net.CIDRMask(0, 0),
+					net.IPv4(10, 0, 0, 1))
+				Expect(err).NotTo(HaveOccurred())
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var results []*current.Result
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				for i := 0; i < 2; i++ {
+					r, _, err := testutils.CmdAddWithArgs(args, func() error {
+						return cmdAdd(args)
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					result, err := current.GetResult(r)
+					Expect(err).NotTo(HaveOccurred())
+					results = append(results, result)
+				}
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results[1]).To(Equal(results[0]))
+			Expect(len(results[1].Routes)).To(Equal(2))
+			Expect(results[1].Routes[1].Dst.String()).To(Equal("20.0.0.0/24"))
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+
+				routes, _ := netlink.RouteList(link, netlink.FAMILY_V4)
+				Expect(len(routes)).To(Equal(3))
+				_, route1, _ := net.ParseCIDR("20.0.0.0/24")
+				Expect(testHasRoute(routes, route1)).To(Equal(true))
+				Expect(testHasRoute(routes, nil)).To(Equal(true))
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reports conflicting addroutes in add mode", func() {
+			conf := []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"rundir": "` + runDir + `",
+				"cniVersion": "0.3.1",
+				"mode": "add",
+				"addroutes": [
+				{
+					"dst": "20.0.0.0/24",
+					"gw": "10.0.0.254"
+				}],
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [
+					{
+						"name": "dummy0", "sandbox":"netns"
+					}],
+					"ips": [
+					{
+						"version": "4",
+						"address": "10.0.0.2/24",
+						"gateway": "10.0.0.1",
+						"interface": 0
+					}]
+				}
+			}`)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   conf,
+			}
+
+			// set address/route as fakeCNI plugin
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				err = netlink.LinkSetUp(link)
+				Expect(err).NotTo(HaveOccurred())
+
+				// addr 10.0.0.2/24
+				err = testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))
+				Expect(err).NotTo(HaveOccurred())
+
+				// "dst": "20.0.0.0/24" already exists
+				err = testAddRoute(link,
+					net.IPv4(20, 0, 0, 0), net.CIDRMask(24, 32),
+					net.IPv4(10, 0, 0, 1))
+				Expect(err).NotTo(HaveOccurred())
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).To(HaveOccurred())
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("dryrun returns the result without changing routes", func() {
+			conf := []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"rundir": "` + runDir + `",
+				"cniVersion": "0.3.1",
+				"dryrun": true,
+				"delroutes": [
+				{
+					"dst": "30.0.0.0/24"
+				}],
+				"addroutes": [
+				{
+					"dst": "20.0.0.0/24"
+				}],
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [
+					{
+						"name": "dummy0", "sandbox":"netns"
+					}],
+					"ips": [
+					{
+						"version": "4",
+						"address": "10.0.0.2/24",
+						"gateway": "10.0.0.1",
+						"interface": 0
+					}],
+					"routes": [
+					{
+						"dst": "30.0.0.0/24"
+					}]
+				}
+			}`)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   conf,
+			}
+
+			// set address/route as fakeCNI plugin
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				err = netlink.LinkSetUp(link)
+				Expect(err).NotTo(HaveOccurred())
+
+				// addr 10.0.0.2/24
+				err = testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32))
+				Expect(err).NotTo(HaveOccurred())
+
+				//"dst": "30.0.0.0/24"
+				err = testAddRoute(link,
+					net.IPv4(30, 0, 0, 0), net.CIDRMask(24, 32),
+					net.IPv4(10, 0, 0, 1))
+				Expect(err).NotTo(HaveOccurred())
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := current.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(result.Routes)).To(Equal(1))
+				Expect(result.Routes[0].Dst.String()).To(Equal("20.0.0.0/24"))
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+
+				routes, _ := netlink.RouteList(link, netlink.FAMILY_V4)
+				Expect(len(routes)).To(Equal(2))
+				_, route1, _ := net.ParseCIDR("30.0.0.0/24")
+				Expect(testHasRoute(routes, route1)).To(Equal(true))
+				_, route2, _ := net.ParseCIDR("20.0.0.0/24")
+				Expect(testHasRoute(routes, route2)).To(Equal(false))
+
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
 	})
 
 	Context("ipv6 route manipulation", func() {
@@ -695,6 +974,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"prevResult": {
 					"cniVersion": "0.3.1",
@@ -800,6 +1080,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"flushroutes": true,
 				"prevResult": {
@@ -906,6 +1187,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"flushgateway": true,
 				"prevResult": {
@@ -1009,6 +1291,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"delroutes": [ { "dst": "2001:DB8:2::/64" } ],
 				"prevResult": {
@@ -1117,6 +1400,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"addroutes": [
 				{
@@ -1220,6 +1504,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"addroutes": [
 				{
@@ -1336,6 +1621,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"addroutes": [
 				{
@@ -1452,6 +1738,7 @@ var _ = Describe("route-override operations by conf, cniVersion:0.4.0", func() {
 			conf := []byte(`{
 				"name": "test",
 				"type": "route-override",
+				"rundir": "` + runDir + `",
 				"cniVersion": "0.3.1",
 				"addroutes": [
 				{
@@ -1572,10 +1859,14 @@ var _ = Describe("route-override operations by args", func() {
 
 	var originalNS ns.NetNS
 	var targetNS ns.NetNS
+	var runDir string
 
 	BeforeEach(func() {
 		// Create a new NetNS so we don't modify the host
 		var err error
+		runDir, err = os.MkdirTemp("", "route-override-args")
+		Expect(err).NotTo(HaveOccurred())
+
 		originalNS, err = testutils.NewNS()
 		Expect(err).NotTo(HaveOccurred())
 
@@ -1601,6 +1892,7 @@ var _ = Describe("route-override operations by args", func() {
 
 	AfterEach(func() {
 		Expect(originalNS.Close()).To(Succeed())
+		Expect(os.RemoveAll(runDir)).To(Succeed())
 	})
 
 	Context("ipv4 route manipulation", func() {
@@ -1608,6 +1900,7 @@ var _ = Describe("route-override operations by args", func() {
 			conf := []byte(`{
 			"name": "test",
 			"type": "route-override",
+			"rundir": "` + runDir + `",
 			"cniVersion": "0.3.1",
 			"args": {
 				"cni": {
@@ -1727,6 +2020,7 @@ var _ = Describe("route-override operations by args", func() {
 			conf := []byte(`{
 			"name": "test",
 			"type": "route-override",
+			"rundir": "` + runDir + `",
 			"cniVersion": "0.3.1",
 			"args": {
 				"cni": {
@@ -1851,6 +2145,7 @@ var _ = Describe("route-override operations by args", func() {
 			conf := []byte(`{
 			"name": "test",
 			"type": "route-override",
+			"rundir": "` + runDir + `",
 			"cniVersion": "0.3.1",
 			"args": {
 				"cni": {
@@ -1972,6 +2267,7 @@ var _ = Describe("route-override operations by args", func() {
 			conf := []byte(`{
 			"name": "test",
 			"type": "route-override",
+			"rundir": "` + runDir + `",
 			"cniVersion": "0.3.1",
 			"args": {
 				"cni": {
@@ -2082,6 +2378,7 @@ var _ = Describe("route-override operations by args", func() {
 			conf := []byte(`{
 			"name": "test",
 			"type": "route-override",
+			"rundir": "` + runDir + `",
 			"cniVersion": "0.3.1",
 			"args": {
 				"cni": {
@@ -2197,6 +2494,7 @@ var _ = Describe("route-override operations by args", func() {
 			conf := []byte(`{
 			"name": "test",
 			"type": "route-override",
+			"rundir": "` + runDir + `",
 			"cniVersion": "0.3.1",
 			"args": {
 				"cni": {
@@ -2299,3 +2597,104 @@ var _ = Describe("route-override operations by args", func() {
 		})
 	})
 })
+
+var _ = Describe("route-override link-local gateways", func() {
+	It("checks routes via link-local gateways on their interface", func() {
+		originalNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer originalNS.Close()
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+		runDir, err := os.MkdirTemp("", "route-override-linklocal")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(runDir)
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, name := range []string{"dummy0", "dummy1"} {
+				err := netlink.LinkAdd(&netlink.Dummy{
+					LinkAttrs: netlink.LinkAttrs{
+						Name: name,
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetUp(link)).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      "dummy1",
+			StdinData: []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"cniVersion": "0.3.1",
+				"rundir": "` + runDir + `",
+				"addroutes": ["fd01::/64 via fe80::1%dummy1", { "dst": "fd02::/64", "gw": "fe80::2" }],
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [
+						{ "name": "dummy0", "sandbox": "netns" },
+						{ "name": "dummy1", "sandbox": "netns" }
+					],
+					"ips": [{ "version": "6", "address": "fd00::2/64", "interface": 1 }]
+				}
+			}`),
+		}
+
+		var result *current.Result
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err = current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Routes).To(HaveLen(2))
+		Expect(result.Routes[0].GW.String()).To(Equal("fe80::1"))
+		Expect(result.Routes[1].GW.String()).To(Equal("fe80::2"))
+
+		// CHECK gets the final result as prevResult
+		conf := map[string]interface{}{}
+		Expect(json.Unmarshal(args.StdinData, &conf)).To(Succeed())
+		conf["prevResult"], err = result.GetAsVersion("0.3.1")
+		Expect(err).NotTo(HaveOccurred())
+		args.StdinData, err = json.Marshal(conf)
+		Expect(err).NotTo(HaveOccurred())
+
+		check := func() error {
+			return originalNS.Do(func(ns.NetNS) error {
+				return testutils.CmdCheckWithArgs(args, func() error {
+					return cmdCheck(args)
+				})
+			})
+		}
+		Expect(check()).To(Succeed())
+
+		// the same route on the other interface does not pass
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, dst, _ := net.ParseCIDR("fd01::/64")
+			routeOn := func(name string) *netlink.Route {
+				link, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				return &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: net.ParseIP("fe80::1")}
+			}
+			Expect(netlink.RouteDel(routeOn("dummy1"))).To(Succeed())
+			Expect(netlink.RouteAdd(routeOn("dummy0"))).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(check()).To(MatchError("route-override: route fd01::/64 via fe80::1 is not on its interface"))
+	})
+})
@@ -0,0 +1,482 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/vishvananda/netlink"
+)
+
+// names used by iproute2 for tables, protocols, scopes and route types
+var (
+	ipRouteTables = map[string]int{
+		"default": syscall.RT_TABLE_DEFAULT,
+		"main":    syscall.RT_TABLE_MAIN,
+		"local":   syscall.RT_TABLE_LOCAL,
+	}
+	ipRouteProtocols = map[string]int{
+		"redirect": syscall.RTPROT_REDIRECT,
+		"kernel":   syscall.RTPROT_KERNEL,
+		"boot":     syscall.RTPROT_BOOT,
+		"static":   syscall.RTPROT_STATIC,
+		"ra":       syscall.RTPROT_RA,
+		"dhcp":     syscall.RTPROT_DHCP,
+	}
+	ipRouteScopes = map[string]int{
+		"global":  int(netlink.SCOPE_UNIVERSE),
+		"site":    int(netlink.SCOPE_SITE),
+		"link":    int(netlink.SCOPE_LINK),
+		"host":    int(netlink.SCOPE_HOST),
+		"nowhere": int(netlink.SCOPE_NOWHERE),
+	}
+	ipRouteTypes = map[string]int{
+		"unicast":     syscall.RTN_UNICAST,
+		"local":       syscall.RTN_LOCAL,
+		"broadcast":   syscall.RTN_BROADCAST,
+		"anycast":     syscall.RTN_ANYCAST,
+		"multicast":   syscall.RTN_MULTICAST,
+		"blackhole":   syscall.RTN_BLACKHOLE,
+		"unreachable": syscall.RTN_UNREACHABLE,
+		"prohibit":    syscall.RTN_PROHIBIT,
+		"throw":       syscall.RTN_THROW,
+	}
+)
+
+// parseIPRouteName parses an iproute2 name or number
+func parseIPRouteName(kind, s string, names map[string]int) (int, error) {
+	if v, ok := names[s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("unknown %s %q", kind, s)
+	}
+	return v, nil
+}
+
+// ipRouteName formats a value by its iproute2 name, if it has one
+func ipRouteName(v int, names map[string]int) string {
+	for name, n := range names {
+		if n == v {
+			return name
+		}
+	}
+	return strconv.Itoa(v)
+}
+
+// RouteEntry is a route given in the configuration or args. It is written
+// either as a JSON object ({"dst": "10.0.0.0/8", "gw": "10.1.1.1"}) or as a
+// string in "ip route" syntax ("10.0.0.0/8 via 10.1.1.1 dev net1").
+type RouteEntry struct {
+	Dst      net.IPNet
+	GW       net.IP
+	Dev      string
+	Metric   int
+	Table    int
+	Protocol int
+	Src      net.IP
+	Scope    netlink.Scope
+	When     *RouteCondition
+
+	// template is the JSON text of a route with template actions, which is
+	// parsed once it is resolved from the CNI result
+	template string
+}
+
+// routeEntryJSON is the JSON object form of RouteEntry
+type routeEntryJSON struct {
+	Dst      string          `json:"dst"`
+	GW       string          `json:"gw,omitempty"`
+	Dev      string          `json:"dev,omitempty"`
+	Metric   int             `json:"metric,omitempty"`
+	Table    json.RawMessage `json:"table,omitempty"`
+	Protocol json.RawMessage `json:"proto,omitempty"`
+	Src      string          `json:"src,omitempty"`
+	Scope    json.RawMessage `json:"scope,omitempty"`
+	When     *RouteCondition `json:"when,omitempty"`
+}
+
+// String formats the route in "ip route" syntax
+func (r *RouteEntry) String() string {
+	if r.template != "" {
+		return r.template
+	}
+	elems := []string{r.Dst.String()}
+	if r.GW != nil {
+		elems = append(elems, "via", r.GW.String())
+	}
+	if r.Dev != "" {
+		elems = append(elems, "dev", r.Dev)
+	}
+	if r.Metric != 0 {
+		elems = append(elems, "metric", strconv.Itoa(r.Metric))
+	}
+	if r.Table != 0 {
+		elems = append(elems, "table", ipRouteName(r.Table, ipRouteTables))
+	}
+	if r.Protocol != 0 {
+		elems = append(elems, "proto", ipRouteName(r.Protocol, ipRouteProtocols))
+	}
+	if r.Src != nil {
+		elems = append(elems, "src", r.Src.String())
+	}
+	if r.Scope != netlink.SCOPE_UNIVERSE {
+		elems = append(elems, "scope", ipRouteName(int(r.Scope), ipRouteScopes))
+	}
+	return strings.Join(elems, " ")
+}
+
+// cniRoute returns the route as it is reported in the CNI result
+func (r *RouteEntry) cniRoute() *types.Route {
+	return &types.Route{Dst: r.Dst, GW: r.GW}
+}
+
+// table returns the routing table of the route, main if not given
+func (r *RouteEntry) table() int {
+	if r.Table == 0 {
+		return syscall.RT_TABLE_MAIN
+	}
+	return r.Table
+}
+
+// matchesResult returns true if the entry selects the route of the CNI
+// result, i.e. a main table route to the same destination, via gw if the
+// entry has a gateway
+func (r *RouteEntry) matchesResult(route *types.Route, gw net.IP) bool {
+	if r.table() != syscall.RT_TABLE_MAIN {
+		return false
+	}
+	if r.GW != nil && !r.GW.Equal(gw) {
+		return false
+	}
+	return route.Dst.IP.Equal(r.Dst.IP) && bytes.Equal(route.Dst.Mask, r.Dst.Mask)
+}
+
+// matchesKernel returns true if the kernel route has the attributes given
+// in the entry. The destination and device are matched by the caller.
+func (r *RouteEntry) matchesKernel(route *kernelRoute) bool {
+	if route.Table != r.table() {
+		return false
+	}
+	if r.GW != nil && !r.GW.Equal(route.Gw) {
+		return false
+	}
+	if r.Metric != 0 && r.Metric != route.Priority {
+		return false
+	}
+	if r.Protocol != 0 && r.Protocol != int(route.Protocol) {
+		return false
+	}
+	return r.Src == nil || r.Src.Equal(route.Src)
+}
+
+// parseRouteAddr parses an address, in 4-byte form for IPv4
+func parseRouteAddr(s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// parseRouteGateway parses a gateway. An IPv6 link-local gateway may name
+// its device as zone, as in fe80::1%net1.
+func parseRouteGateway(s string) (net.IP, string, error) {
+	addr, zone, _ := strings.Cut(s, "%")
+	gw := parseRouteAddr(addr)
+	if gw == nil || strings.HasSuffix(s, "%") {
+		return nil, "", fmt.Errorf("invalid gateway %q", s)
+	}
+	if zone != "" && !isLinkLocalGW(gw) {
+		return nil, "", fmt.Errorf("invalid gateway %q: only IPv6 link-local gateways take a device", s)
+	}
+	return gw, zone, nil
+}
+
+// isLinkLocalGW returns true for IPv6 link-local gateways, which are only
+// meaningful together with a device
+func isLinkLocalGW(gw net.IP) bool {
+	return gw != nil && gw.To4() == nil && gw.IsLinkLocalUnicast()
+}
+
+// setGatewayDev sets the device named by the zone of the gateway, which
+// must agree with dev if both are given
+func (r *RouteEntry) setGatewayDev(zone string) error {
+	if zone == "" {
+		return nil
+	}
+	if r.Dev != "" && r.Dev != zone {
+		return fmt.Errorf("gateway device %q differs from dev %q", zone, r.Dev)
+	}
+	r.Dev = zone
+	return nil
+}
+
+// routeFamily returns the family that "default" stands for in a route with
+// the given gateway and source address: that of the gateway, or else that
+// of the source address, or else IPv4
+func routeFamily(gw, src net.IP) int {
+	for _, ip := range []net.IP{gw, src} {
+		if ip != nil {
+			if ip.To4() == nil {
+				return netlink.FAMILY_V6
+			}
+			return netlink.FAMILY_V4
+		}
+	}
+	return netlink.FAMILY_V4
+}
+
+// parseRouteDst parses a route destination: a prefix, a single address,
+// "default" of the given family, or "default4" or "default6". The address
+// is kept as written, like in "dst" of CNI routes.
+func parseRouteDst(s string, family int) (*net.IPNet, error) {
+	switch s {
+	case "default":
+		return defaultDst(family), nil
+	case "default4":
+		return defaultDst(netlink.FAMILY_V4), nil
+	case "default6":
+		return defaultDst(netlink.FAMILY_V6), nil
+	}
+	if !strings.Contains(s, "/") {
+		ip := parseRouteAddr(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid destination %q", s)
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	dst, err := types.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %q", s)
+	}
+	return dst, nil
+}
+
+// routeEntryKeywords are the keywords of "ip route" syntax that are accepted
+var routeEntryKeywords = map[string]bool{
+	"via": true, "dev": true, "metric": true, "preference": true,
+	"priority": true, "table": true, "proto": true, "protocol": true,
+	"src": true, "scope": true,
+}
+
+// parseRouteEntry parses a route in "ip route" syntax:
+//
+//	[to] PREFIX|default [via ADDR] [dev NAME] [metric N] [table ID]
+//	[proto ID] [src ADDR] [scope ID]
+func parseRouteEntry(s string) (*RouteEntry, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid route %q: missing destination", s)
+	}
+	if fields[0] == "to" {
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid route %q: missing value for \"to\"", s)
+		}
+	}
+	dst := fields[0]
+
+	r := &RouteEntry{}
+	zone := ""
+	seen := map[string]bool{}
+	for i := 1; i < len(fields); i += 2 {
+		key := fields[i]
+		if !routeEntryKeywords[key] {
+			return nil, fmt.Errorf("invalid route %q: unknown keyword %q", s, key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("invalid route %q: duplicate %q", s, key)
+		}
+		seen[key] = true
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("invalid route %q: missing value for %q", s, key)
+		}
+		value := fields[i+1]
+
+		var err error
+		switch key {
+		case "via":
+			r.GW, zone, err = parseRouteGateway(value)
+		case "dev":
+			r.Dev = value
+		case "metric", "preference", "priority":
+			if r.Metric, err = strconv.Atoi(value); err != nil || r.Metric < 0 {
+				err = fmt.Errorf("invalid metric %q", value)
+			}
+		case "table":
+			r.Table, err = parseIPRouteName("table", value, ipRouteTables)
+		case "proto", "protocol":
+			r.Protocol, err = parseIPRouteName("protocol", value, ipRouteProtocols)
+		case "src":
+			if r.Src = parseRouteAddr(value); r.Src == nil {
+				err = fmt.Errorf("invalid source address %q", value)
+			}
+		case "scope":
+			var scope int
+			scope, err = parseIPRouteName("scope", value, ipRouteScopes)
+			r.Scope = netlink.Scope(scope)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %v", s, err)
+		}
+	}
+
+	if err := r.setGatewayDev(zone); err != nil {
+		return nil, fmt.Errorf("invalid route %q: %v", s, err)
+	}
+
+	d, err := parseRouteDst(dst, routeFamily(r.GW, r.Src))
+	if err != nil {
+		return nil, fmt.Errorf("invalid route %q: %v", s, err)
+	}
+	r.Dst = *d
+	return r, nil
+}
+
+// parseRawRouteName parses a JSON number or iproute2 name
+func parseRawRouteName(kind string, raw json.RawMessage, names map[string]int) (int, error) {
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		s = string(raw)
+	}
+	return parseIPRouteName(kind, s, names)
+}
+
+// UnmarshalJSON accepts a route as JSON object or "ip route" string
+func (r *RouteEntry) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if isTemplate(data) {
+		entry, err := newTemplateEntry(data)
+		if err != nil {
+			return err
+		}
+		*r = *entry
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		entry, err := parseRouteEntry(s)
+		if err != nil {
+			return err
+		}
+		*r = *entry
+		return nil
+	}
+
+	obj := routeEntryJSON{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	if obj.Dst == "" {
+		return fmt.Errorf("invalid route %s: missing \"dst\"", data)
+	}
+	entry, err := obj.entry()
+	if err != nil {
+		return fmt.Errorf("invalid route %s: %v", data, err)
+	}
+	*r = *entry
+	return nil
+}
+
+// entry parses the fields of the object. The destination is left unset if
+// "dst" is missing.
+func (obj *routeEntryJSON) entry() (*RouteEntry, error) {
+	entry := &RouteEntry{Dev: obj.Dev, Metric: obj.Metric, When: obj.When}
+	if obj.When != nil {
+		if err := obj.When.validate(); err != nil {
+			return nil, fmt.Errorf("invalid when: %v", err)
+		}
+	}
+	if obj.GW != "" {
+		gw, zone, err := parseRouteGateway(obj.GW)
+		if err != nil {
+			return nil, err
+		}
+		entry.GW = gw
+		if err := entry.setGatewayDev(zone); err != nil {
+			return nil, err
+		}
+	}
+	if obj.Src != "" {
+		if entry.Src = parseRouteAddr(obj.Src); entry.Src == nil {
+			return nil, fmt.Errorf("invalid src %q", obj.Src)
+		}
+	}
+	if obj.Dst != "" {
+		dst, err := parseRouteDst(obj.Dst, routeFamily(entry.GW, entry.Src))
+		if err != nil {
+			return nil, err
+		}
+		entry.Dst = *dst
+	}
+	var err error
+	if entry.Table, err = parseRawRouteName("table", obj.Table, ipRouteTables); err != nil {
+		return nil, err
+	}
+	if entry.Protocol, err = parseRawRouteName("protocol", obj.Protocol, ipRouteProtocols); err != nil {
+		return nil, err
+	}
+	scope, err := parseRawRouteName("scope", obj.Scope, ipRouteScopes)
+	if err != nil {
+		return nil, err
+	}
+	entry.Scope = netlink.Scope(scope)
+	return entry, nil
+}
+
+// MarshalJSON writes the route as JSON object
+func (r RouteEntry) MarshalJSON() ([]byte, error) {
+	if r.template != "" {
+		return []byte(r.template), nil
+	}
+	obj := routeEntryJSON{
+		Dst:    r.Dst.String(),
+		Dev:    r.Dev,
+		Metric: r.Metric,
+		When:   r.When,
+	}
+	if r.GW != nil {
+		obj.GW = r.GW.String()
+	}
+	if r.Src != nil {
+		obj.Src = r.Src.String()
+	}
+	if r.Table != 0 {
+		obj.Table, _ = json.Marshal(ipRouteName(r.Table, ipRouteTables))
+	}
+	if r.Protocol != 0 {
+		obj.Protocol, _ = json.Marshal(ipRouteName(r.Protocol, ipRouteProtocols))
+	}
+	if r.Scope != netlink.SCOPE_UNIVERSE {
+		obj.Scope, _ = json.Marshal(ipRouteName(int(r.Scope), ipRouteScopes))
+	}
+	return json.Marshal(obj)
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override route entries", func() {
+	It("parses ip route syntax", func() {
+		for s, expected := range map[string]string{
+			"192.168.0.0/24":                                   "192.168.0.0/24",
+			"to 192.168.0.0/24 via 10.1.254.254":               "192.168.0.0/24 via 10.1.254.254",
+			"default via 10.1.0.1 dev net1 metric 100":         "0.0.0.0/0 via 10.1.0.1 dev net1 metric 100",
+			"default via fd00::1":                              "::/0 via fd00::1",
+			"default6 dev net1":                                "::/0 dev net1",
+			"default4 dev net1":                                "0.0.0.0/0 dev net1",
+			"default dev net1 src fd00::2":                     "::/0 dev net1 src fd00::2",
+			"10.2.0.1 dev net1 scope link":                     "10.2.0.1/32 dev net1 scope link",
+			"10.3.0.0/16 via 10.1.0.1 table 200 proto static":  "10.3.0.0/16 via 10.1.0.1 table 200 proto static",
+			"10.4.0.0/16 via 10.1.0.1 src 10.1.0.5 priority 5": "10.4.0.0/16 via 10.1.0.1 metric 5 src 10.1.0.5",
+		} {
+			entry, err := parseRouteEntry(s)
+			Expect(err).NotTo(HaveOccurred(), s)
+			Expect(entry.String()).To(Equal(expected), s)
+		}
+	})
+
+	It("reports invalid ip route syntax", func() {
+		for s, expected := range map[string]string{
+			"":                               `invalid route "": missing destination`,
+			"10.0.0.0/8 via":                 `invalid route "10.0.0.0/8 via": missing value for "via"`,
+			"10.0.0.0/8 via 10.0.0.1 onlink": `invalid route "10.0.0.0/8 via 10.0.0.1 onlink": unknown keyword "onlink"`,
+			"10.0.0.0/8 dev a dev b":         `invalid route "10.0.0.0/8 dev a dev b": duplicate "dev"`,
+			"10.0.0.0/8 via 10.0.0.256":      `invalid route "10.0.0.0/8 via 10.0.0.256": invalid gateway "10.0.0.256"`,
+			"10.0.0.0/8 metric -1":           `invalid route "10.0.0.0/8 metric -1": invalid metric "-1"`,
+			"10.0.0.0/8 table custom":        `invalid route "10.0.0.0/8 table custom": unknown table "custom"`,
+			"10.0.0.0/33":                    `invalid route "10.0.0.0/33": invalid destination "10.0.0.0/33"`,
+		} {
+			_, err := parseRouteEntry(s)
+			Expect(err).To(MatchError(expected), s)
+		}
+	})
+
+	It("accepts strings and objects in JSON", func() {
+		entries := []*RouteEntry{}
+		err := json.Unmarshal([]byte(`[
+			"10.1.0.0/16 via 10.0.0.1 dev net1",
+			{"dst": "10.2.0.0/16", "gw": "10.0.0.1"},
+			{"dst": "default", "gw": "fd00::1", "metric": 10, "table": "main"},
+			{"dst": "10.3.0.0/16", "dev": "net1", "table": 200, "proto": "static", "scope": "link"},
+			{"dst": "default6", "dev": "net1"}
+		]`), &entries)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries[0].String()).To(Equal("10.1.0.0/16 via 10.0.0.1 dev net1"))
+		Expect(entries[1].String()).To(Equal("10.2.0.0/16 via 10.0.0.1"))
+		Expect(entries[2].String()).To(Equal("::/0 via fd00::1 metric 10 table main"))
+		Expect(entries[3].String()).To(Equal("10.3.0.0/16 dev net1 table 200 proto static scope link"))
+		Expect(entries[4].String()).To(Equal("::/0 dev net1"))
+
+		data, err := json.Marshal(entries[3])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"dst":"10.3.0.0/16","dev":"net1","table":"200","proto":"static","scope":"link"}`))
+
+		err = json.Unmarshal([]byte(`[{"gw": "10.0.0.1"}]`), &entries)
+		Expect(err).To(MatchError(`invalid route {"gw": "10.0.0.1"}: missing "dst"`))
+		err = json.Unmarshal([]byte(`["10.1.0.0/16 nexthop via 10.0.0.1"]`), &entries)
+		Expect(err).To(MatchError(`invalid route "10.1.0.0/16 nexthop via 10.0.0.1": unknown keyword "nexthop"`))
+	})
+
+	It("takes the device of link-local gateways", func() {
+		for s, expected := range map[string]string{
+			"default via fe80::1":                  "::/0 via fe80::1",
+			"fd01::/64 via fe80::1%net1":           "fd01::/64 via fe80::1 dev net1",
+			"default via fe80::1%net1 dev net1":    "::/0 via fe80::1 dev net1",
+			"default via fe80::1 dev net1":         "::/0 via fe80::1 dev net1",
+			"fd01::/64 via fd00::1":                "fd01::/64 via fd00::1",
+			"169.254.0.0/16 via 169.254.0.1 dev x": "169.254.0.0/16 via 169.254.0.1 dev x",
+		} {
+			entry, err := parseRouteEntry(s)
+			Expect(err).NotTo(HaveOccurred(), s)
+			Expect(entry.String()).To(Equal(expected), s)
+		}
+
+		for s, expected := range map[string]string{
+			"default via fe80::1%net1 dev net2": `invalid route "default via fe80::1%net1 dev net2": gateway device "net1" differs from dev "net2"`,
+			"default via fd00::1%net1":          `invalid route "default via fd00::1%net1": invalid gateway "fd00::1%net1": only IPv6 link-local gateways take a device`,
+			"default via fe80::1%":              `invalid route "default via fe80::1%": invalid gateway "fe80::1%"`,
+		} {
+			_, err := parseRouteEntry(s)
+			Expect(err).To(MatchError(expected), s)
+		}
+
+		entries := []*RouteEntry{}
+		Expect(json.Unmarshal([]byte(`[
+			{"dst": "default", "gw": "fe80::1%net1"},
+			{"dst": "fd01::/64", "gw": "fe80::1", "dev": "net1"},
+			{"dst": "::/0", "gw": "fe80::1"}
+		]`), &entries)).To(Succeed())
+		Expect(testRouteStrings(entries)).To(Equal([]string{"::/0 via fe80::1 dev net1", "fd01::/64 via fe80::1 dev net1", "::/0 via fe80::1"}))
+
+		// matches select routes on any device
+		match := &routeMatch{}
+		Expect(json.Unmarshal([]byte(`{"gw": "fe80::1"}`), match)).To(Succeed())
+	})
+
+	It("selects kernel routes by the given attributes", func() {
+		entry, err := parseRouteEntry("30.0.0.0/24 via 10.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entry.matchesKernel(testJournalRoute("30.0.0.0/24", "10.0.0.1"))).To(BeTrue())
+		Expect(entry.matchesKernel(testJournalRoute("30.0.0.0/24", "10.0.0.254"))).To(BeFalse())
+
+		route := testJournalRoute("30.0.0.0/24", "10.0.0.1")
+		route.Table = 200
+		Expect(entry.matchesKernel(route)).To(BeFalse())
+		entry.Table = 200
+		Expect(entry.matchesKernel(route)).To(BeTrue())
+	})
+})
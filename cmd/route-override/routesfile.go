@@ -0,0 +1,124 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// lineAt returns the line number of the byte offset in data
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// parseJSONRoutesFile parses a JSON array of route entries, reporting
+// errors with the line of the offending entry
+func parseJSONRoutesFile(path string, data []byte) ([]*RouteEntry, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("%s:%d: expected a JSON array of routes", path, lineAt(data, dec.InputOffset()))
+	}
+
+	routes := []*RouteEntry{}
+	for dec.More() {
+		// skip the separator to report the line where the entry starts
+		start := dec.InputOffset()
+		for start < int64(len(data)) && strings.ContainsRune(" \t\r\n,", rune(data[start])) {
+			start++
+		}
+		route := &RouteEntry{}
+		if err := dec.Decode(route); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineAt(data, start), err)
+		}
+		routes = append(routes, route)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("%s:%d: %v", path, lineAt(data, dec.InputOffset()), err)
+	}
+	return routes, nil
+}
+
+// parseTextRoutesFile parses one route per line in "ip route" syntax.
+// Empty lines and lines starting with "#" are ignored.
+func parseTextRoutesFile(path string, data []byte) ([]*RouteEntry, error) {
+	routes := []*RouteEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var route *RouteEntry
+		var err error
+		if isTemplate([]byte(text)) {
+			raw, _ := json.Marshal(text)
+			route, err = newTemplateEntry(raw)
+		} else {
+			route, err = parseRouteEntry(text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		routes = append(routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return routes, nil
+}
+
+// loadRoutesFile reads route entries from a file, either a JSON array or
+// "ip route" syntax
+func loadRoutesFile(path string) ([]*RouteEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes file: %v", err)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return parseJSONRoutesFile(path, data)
+	}
+	return parseTextRoutesFile(path, data)
+}
+
+// loadRoutesFiles appends the entries of routesfile and delroutesfile to
+// the inline addroutes and delroutes, and loads the protected routes
+func (conf *RouteOverrideConfig) loadRoutesFiles() error {
+	if err := conf.loadProtectedRoutes(); err != nil {
+		return err
+	}
+	if conf.DelRoutesFile != "" {
+		routes, err := loadRoutesFile(conf.DelRoutesFile)
+		if err != nil {
+			return err
+		}
+		conf.DelRoutes = append(conf.DelRoutes, routes...)
+	}
+	if conf.RoutesFile != "" {
+		routes, err := loadRoutesFile(conf.RoutesFile)
+		if err != nil {
+			return err
+		}
+		conf.AddRoutes = append(conf.AddRoutes, routes...)
+	}
+	return nil
+}
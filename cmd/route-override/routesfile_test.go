@@ -0,0 +1,101 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override routes files", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "route-override-routesfile")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(data), 0600)).To(Succeed())
+		return path
+	}
+
+	It("merges routes files with the inline routes", func() {
+		routesFile := writeFile("routes", `
+# customer prefixes
+10.10.0.0/16 via 10.1.254.254
+
+10.20.0.0/16 via 10.1.254.254 metric 100
+`)
+		delRoutesFile := writeFile("delroutes.json", `[
+			"10.30.0.0/16",
+			{"dst": "10.40.0.0/16", "gw": "10.1.254.1"}
+		]`)
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"delroutes": [{"dst": "192.168.0.0/24"}],
+			"addroutes": [{"dst": "192.168.1.0/24", "gw": "10.1.254.254"}],
+			"routesfile": "`+routesFile+`",
+			"delroutesfile": "`+delRoutesFile+`"
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.loadRoutesFiles()).To(Succeed())
+
+		routes := []string{}
+		for _, route := range conf.AddRoutes {
+			routes = append(routes, route.String())
+		}
+		Expect(routes).To(Equal([]string{
+			"192.168.1.0/24 via 10.1.254.254",
+			"10.10.0.0/16 via 10.1.254.254",
+			"10.20.0.0/16 via 10.1.254.254 metric 100",
+		}))
+		routes = []string{}
+		for _, route := range conf.DelRoutes {
+			routes = append(routes, route.String())
+		}
+		Expect(routes).To(Equal([]string{
+			"192.168.0.0/24",
+			"10.30.0.0/16",
+			"10.40.0.0/16 via 10.1.254.1",
+		}))
+	})
+
+	It("reports errors with the file and line", func() {
+		path := writeFile("routes", "10.10.0.0/16 via 10.1.254.254\n\n10.20.0.0/16 gw 10.1.254.254\n")
+		_, err := loadRoutesFile(path)
+		Expect(err).To(MatchError(path + `:3: invalid route "10.20.0.0/16 gw 10.1.254.254": unknown keyword "gw"`))
+
+		path = writeFile("routes.json", "[\n  \"10.10.0.0/16\",\n  {\"gw\": \"10.1.254.254\"}\n]\n")
+		_, err = loadRoutesFile(path)
+		Expect(err).To(MatchError(path + `:3: invalid route {"gw": "10.1.254.254"}: missing "dst"`))
+
+		_, err = loadRoutesFile(filepath.Join(dir, "missing"))
+		Expect(err).To(HaveOccurred())
+	})
+})
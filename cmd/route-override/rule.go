@@ -0,0 +1,210 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/vishvananda/netlink"
+)
+
+// kernelRule is a policy routing rule, serializable like kernelRoute
+type kernelRule struct {
+	Family   int          `json:"family"`
+	Src      *types.IPNet `json:"from,omitempty"`
+	Dst      *types.IPNet `json:"to,omitempty"`
+	IifName  string       `json:"iif,omitempty"`
+	OifName  string       `json:"oif,omitempty"`
+	Mark     int          `json:"fwmark,omitempty"`
+	Table    int          `json:"table"`
+	Priority int          `json:"priority,omitempty"`
+}
+
+// String formats the rule in "ip rule" syntax. IPv6 rules without an
+// address are marked with -6.
+func (r *kernelRule) String() string {
+	elems := []string{"from", "all"}
+	if r.Family == netlink.FAMILY_V6 && r.Src == nil && r.Dst == nil {
+		elems = append([]string{"-6"}, elems...)
+	}
+	if r.Src != nil {
+		elems[1] = (*net.IPNet)(r.Src).String()
+	}
+	if r.Dst != nil {
+		elems = append(elems, "to", (*net.IPNet)(r.Dst).String())
+	}
+	if r.IifName != "" {
+		elems = append(elems, "iif", r.IifName)
+	}
+	if r.OifName != "" {
+		elems = append(elems, "oif", r.OifName)
+	}
+	if r.Mark != 0 {
+		elems = append(elems, "fwmark", fmt.Sprintf("%#x", r.Mark))
+	}
+	elems = append(elems, "lookup", ipRouteName(r.Table, ipRouteTables))
+	if r.Priority != 0 {
+		elems = append(elems, "priority", strconv.Itoa(r.Priority))
+	}
+	return strings.Join(elems, " ")
+}
+
+// netlinkRule converts the rule into a netlink.Rule
+func (r *kernelRule) netlinkRule() *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = r.Family
+	rule.Src = (*net.IPNet)(r.Src)
+	rule.Dst = (*net.IPNet)(r.Dst)
+	rule.IifName = r.IifName
+	rule.OifName = r.OifName
+	rule.Table = r.Table
+	if r.Mark != 0 {
+		rule.Mark = r.Mark
+	}
+	if r.Priority != 0 {
+		rule.Priority = r.Priority
+	}
+	return rule
+}
+
+// ruleFamily returns the family of an address
+func ruleFamily(ip net.IP) int {
+	if ip.To4() == nil {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// parseRuleEntry parses a rule in "ip rule" syntax:
+//
+//	[-4|-6] [from PREFIX|all] [to PREFIX] [iif NAME] [oif NAME] [fwmark N]
+//	table|lookup ID [priority N]
+//
+// The family is taken from the addresses, or else from -4 or -6, and
+// defaults to IPv4.
+func parseRuleEntry(s string) (*kernelRule, error) {
+	fields := strings.Fields(s)
+	r := &kernelRule{Family: netlink.FAMILY_V4}
+	family := 0
+	if len(fields) > 0 {
+		switch fields[0] {
+		case "-4":
+			family = netlink.FAMILY_V4
+		case "-6":
+			family = netlink.FAMILY_V6
+		}
+		if family != 0 {
+			r.Family = family
+			fields = fields[1:]
+		}
+	}
+	seen := map[string]bool{}
+	for i := 0; i < len(fields); i += 2 {
+		key := fields[i]
+		switch key {
+		case "lookup":
+			key = "table"
+		case "pref", "preference":
+			key = "priority"
+		}
+		switch key {
+		case "from", "to", "iif", "oif", "fwmark", "table", "priority":
+		default:
+			return nil, fmt.Errorf("invalid rule %q: unknown keyword %q", s, fields[i])
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("invalid rule %q: duplicate %q", s, key)
+		}
+		seen[key] = true
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("invalid rule %q: missing value for %q", s, fields[i])
+		}
+		value := fields[i+1]
+
+		var err error
+		switch key {
+		case "from", "to":
+			if value == "all" {
+				break
+			}
+			var prefix *net.IPNet
+			if prefix, err = parseRouteDst(value, netlink.FAMILY_V4); err != nil {
+				break
+			}
+			if family != 0 && ruleFamily(prefix.IP) != family {
+				err = fmt.Errorf("%s %s is not of the family given by %s", key, value, strings.Fields(s)[0])
+				break
+			}
+			r.Family = ruleFamily(prefix.IP)
+			if key == "from" {
+				r.Src = (*types.IPNet)(prefix)
+			} else {
+				r.Dst = (*types.IPNet)(prefix)
+			}
+		case "iif":
+			r.IifName = value
+		case "oif":
+			r.OifName = value
+		case "fwmark":
+			var mark int64
+			if mark, err = strconv.ParseInt(value, 0, 32); err != nil || mark <= 0 {
+				err = fmt.Errorf("invalid fwmark %q", value)
+			}
+			r.Mark = int(mark)
+		case "table":
+			r.Table, err = parseIPRouteName("table", value, ipRouteTables)
+		case "priority":
+			if r.Priority, err = strconv.Atoi(value); err != nil || r.Priority <= 0 {
+				err = fmt.Errorf("invalid priority %q", value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", s, err)
+		}
+	}
+	if r.Table == 0 {
+		return nil, fmt.Errorf("invalid rule %q: missing table", s)
+	}
+	if r.Src != nil && r.Dst != nil && ruleFamily(r.Src.IP) != ruleFamily(r.Dst.IP) {
+		return nil, fmt.Errorf("invalid rule %q: mixed address families", s)
+	}
+	return r, nil
+}
+
+// UnmarshalJSON accepts a rule as "ip rule" string
+func (r *kernelRule) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return fmt.Errorf("invalid rule null: missing table")
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		rule, err := parseRuleEntry(s)
+		if err != nil {
+			return err
+		}
+		*r = *rule
+		return nil
+	}
+
+	// the journal records rules as objects
+	type plain kernelRule
+	return json.Unmarshal(data, (*plain)(r))
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// jsonSchema is a JSON Schema object
+type jsonSchema map[string]interface{}
+
+// schemaEnums are the allowed values of string and integer keys, or of the
+// items of list keys, by type name and key
+var schemaEnums = map[string][]interface{}{
+	"RouteOverrideConfig.mode":        {modeReplace, modeAdd},
+	"RouteOverrideConfig.onprotected": {onProtectedFail, onProtectedSkip},
+	"RouteOverrideConfig.argsmerge":   {argsMergeReplace, argsMergeAppend, argsMergePrepend},
+	"RouteOverrideConfig.locked":      sortedArgsFields(),
+	"ArgsAllowConfig.fields":          sortedArgsFields(),
+	"routeStep.op":                    {stepFlush, stepDelete, stepAdd, stepReplace, stepRule},
+	"RouteCondition.family":           {4, 6},
+}
+
+// schemaRequired are the keys that an object must have, by type name
+var schemaRequired = map[string][]string{
+	"routeEntryJSON": {"dst"},
+	"routeStep":      {"op"},
+}
+
+func sortedArgsFields() []interface{} {
+	fields := []string{}
+	for field := range argsFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	values := []interface{}{}
+	for _, field := range fields {
+		values = append(values, field)
+	}
+	return values
+}
+
+// schemaGenerator derives the schema from the Go types of the
+// configuration. Named structs become definitions.
+type schemaGenerator struct {
+	defs jsonSchema
+}
+
+// ref returns a reference to the definition, which build creates on the
+// first use
+func (g *schemaGenerator) ref(name string, build func() jsonSchema) jsonSchema {
+	if _, ok := g.defs[name]; !ok {
+		// a placeholder ends recursion through the type
+		g.defs[name] = jsonSchema{}
+		g.defs[name] = build()
+	}
+	return jsonSchema{"$ref": "#/$defs/" + name}
+}
+
+// defName returns the name of the definition of a type
+func defName(t reflect.Type) string {
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+// schema returns the schema of a value of the type at the path
+func (g *schemaGenerator) schema(path string, t reflect.Type) jsonSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case reflect.TypeOf(types.IPNet{}):
+		return jsonSchema{"type": "string", "description": "IP prefix in CIDR notation"}
+	case reflect.TypeOf(net.IP{}):
+		return jsonSchema{"type": "string", "description": "IP address"}
+	case reflect.TypeOf(json.RawMessage{}):
+		// the raw keys of route entries are numbers or iproute2 names
+		return jsonSchema{"type": []string{"integer", "string"}}
+	case reflect.TypeOf(RouteEntry{}):
+		return g.ref("RouteEntry", func() jsonSchema {
+			return jsonSchema{"oneOf": []jsonSchema{
+				{"type": "string", "description": "route in \"ip route\" syntax, or a route template"},
+				g.object("", reflect.TypeOf(routeEntryJSON{})),
+			}}
+		})
+	case reflect.TypeOf(routeMatch{}):
+		return g.ref("RouteMatch", func() jsonSchema {
+			match := g.object("", reflect.TypeOf(routeEntryJSON{}))
+			delete(match["properties"].(jsonSchema), "when")
+			delete(match, "required")
+			return match
+		})
+	case reflect.TypeOf(kernelRule{}):
+		return g.ref("Rule", func() jsonSchema {
+			return jsonSchema{"oneOf": []jsonSchema{
+				{"type": "string", "description": "rule in \"ip rule\" syntax"},
+				g.object("", t),
+			}}
+		})
+	}
+
+	if path == "profiles" {
+		return jsonSchema{"type": "object", "additionalProperties": jsonSchema{"$ref": "#/$defs/Profile"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice:
+		return jsonSchema{"type": "array", "items": g.schema(path+"[]", t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": g.schema(path+".*", t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(path, t)
+		}
+		return g.ref(defName(t), func() jsonSchema { return g.object(path, t) })
+	}
+	return jsonSchema{}
+}
+
+// object returns the schema of a struct. Objects that may have keys of
+// other plugins allow additional keys.
+func (g *schemaGenerator) object(path string, t reflect.Type) jsonSchema {
+	properties := jsonSchema{}
+	fields := jsonFields(t)
+	for key, ft := range fields {
+		prop := g.schema(joinPath(path, key), ft)
+		if values, ok := schemaEnums[t.Name()+"."+key]; ok {
+			if prop["type"] == "array" {
+				prop["items"].(jsonSchema)["enum"] = values
+			} else {
+				prop["enum"] = values
+			}
+		}
+		properties[key] = prop
+	}
+
+	obj := jsonSchema{"type": "object", "properties": properties}
+	if !openObjects[path] {
+		obj["additionalProperties"] = false
+	}
+	if required, ok := schemaRequired[t.Name()]; ok {
+		obj["required"] = required
+	}
+	return obj
+}
+
+// configSchema returns the schema of the plugin configuration
+func configSchema() jsonSchema {
+	g := &schemaGenerator{defs: jsonSchema{}}
+	root := g.object("", reflect.TypeOf(RouteOverrideConfig{}))
+
+	// a profile has the keys of the configuration, and its selectors
+	profile := jsonSchema{}
+	for key, prop := range root["properties"].(jsonSchema) {
+		profile[key] = prop
+	}
+	profile["match"] = g.schema("", reflect.TypeOf(profileMatch{}))
+	profile["when"] = g.schema("", reflect.TypeOf(RouteCondition{}))
+	g.defs["Profile"] = jsonSchema{"type": "object", "properties": profile, "additionalProperties": false}
+
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["title"] = "route-override configuration"
+	root["$defs"] = g.defs
+	return root
+}
+
+// runSchema prints the JSON Schema of the plugin configuration
+func runSchema(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("schema", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schema: %v", err)
+	}
+	fmt.Fprintln(stdout, string(data))
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testSchemaErrors validates a document against the subset of JSON Schema
+// that configSchema generates
+func testSchemaErrors(root, schema map[string]interface{}, path string, doc interface{}) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		def := root["$defs"].(map[string]interface{})[strings.TrimPrefix(ref, "#/$defs/")]
+		return testSchemaErrors(root, def.(map[string]interface{}), path, doc)
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if len(testSchemaErrors(root, sub.(map[string]interface{}), path, doc)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return []string{fmt.Sprintf("%s: matches %d of oneOf", path, matches)}
+		}
+		return nil
+	}
+
+	if t, ok := schema["type"]; ok {
+		typeNames := []interface{}{t}
+		if list, ok := t.([]interface{}); ok {
+			typeNames = list
+		}
+		matched := false
+		for _, name := range typeNames {
+			switch v := doc.(type) {
+			case bool:
+				matched = matched || name == "boolean"
+			case float64:
+				matched = matched || name == "integer" && v == float64(int64(v))
+			case string:
+				matched = matched || name == "string"
+			case []interface{}:
+				matched = matched || name == "array"
+			case map[string]interface{}:
+				matched = matched || name == "object"
+			}
+		}
+		if !matched {
+			return []string{fmt.Sprintf("%s: must be %v", path, t)}
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, value := range enum {
+			found = found || value == doc
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: must be one of %v", path, enum)}
+		}
+	}
+
+	problems := []string{}
+	switch v := doc.(type) {
+	case []interface{}:
+		for i, elem := range v {
+			problems = append(problems, testSchemaErrors(root, schema["items"].(map[string]interface{}), fmt.Sprintf("%s[%d]", path, i), elem)...)
+		}
+	case map[string]interface{}:
+		required, _ := schema["required"].([]interface{})
+		for _, key := range required {
+			if _, ok := v[key.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing %v", path, key))
+			}
+		}
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		properties, _ := schema["properties"].(map[string]interface{})
+		for _, key := range keys {
+			sub, ok := properties[key].(map[string]interface{})
+			if !ok {
+				sub, ok = schema["additionalProperties"].(map[string]interface{})
+			}
+			if !ok {
+				if schema["additionalProperties"] == false {
+					problems = append(problems, fmt.Sprintf("%s: unknown key", joinPath(path, key)))
+				}
+				continue
+			}
+			problems = append(problems, testSchemaErrors(root, sub, joinPath(path, key), v[key])...)
+		}
+	}
+	return problems
+}
+
+// testReadmeConfigs returns the configurations of the README examples.
+// Fragments of a configuration are wrapped into an object, and the
+// route-override plugins of a configuration list are taken from the list.
+func testReadmeConfigs() []map[string]interface{} {
+	readme, err := os.ReadFile("../../README.md")
+	Expect(err).NotTo(HaveOccurred())
+
+	configs := []map[string]interface{}{}
+	blocks := strings.Split(string(readme), "```")
+	for i := 1; i < len(blocks); i += 2 {
+		block := strings.TrimSpace(blocks[i])
+		if strings.HasPrefix(block, `"`) {
+			block = "{" + block + "}"
+		} else if !strings.HasPrefix(block, "{") {
+			continue
+		}
+		// elided settings of other plugins
+		block = strings.ReplaceAll(block, "...", "")
+
+		conf := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(block), &conf)).To(Succeed(), block)
+		plugins, ok := conf["plugins"].([]interface{})
+		if !ok {
+			configs = append(configs, conf)
+			continue
+		}
+		for _, plugin := range plugins {
+			if plugin.(map[string]interface{})["type"] == "route-override" {
+				configs = append(configs, plugin.(map[string]interface{}))
+			}
+		}
+	}
+	return configs
+}
+
+var _ = Describe("route-override configuration schema", func() {
+	var schema map[string]interface{}
+
+	BeforeEach(func() {
+		out := &bytes.Buffer{}
+		Expect(runSchema(nil, out)).To(Succeed())
+		schema = map[string]interface{}{}
+		Expect(json.Unmarshal(out.Bytes(), &schema)).To(Succeed())
+	})
+
+	It("accepts the README examples", func() {
+		configs := testReadmeConfigs()
+		Expect(len(configs)).To(BeNumerically(">", 10))
+		for _, conf := range configs {
+			Expect(testSchemaErrors(schema, schema, "", conf)).To(BeEmpty(), fmt.Sprintf("%v", conf))
+		}
+	})
+
+	It("has every key of the configuration and of args", func() {
+		properties := schema["properties"].(map[string]interface{})
+		for _, key := range []string{"cniVersion", "capabilities", "prevResult", "addroutes", "operations", "profiles", "strict", "rules"} {
+			Expect(properties).To(HaveKey(key))
+		}
+		ipamArgs := schema["$defs"].(map[string]interface{})["IPAMArgs"].(map[string]interface{})
+		for field := range argsFields {
+			Expect(ipamArgs["properties"]).To(HaveKey(field))
+		}
+	})
+
+	It("rejects invalid configurations", func() {
+		conf := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(`{
+			"type": "route-override",
+			"flushroute": true,
+			"mode": "merge",
+			"addroutes": ["10.0.0.0/8 via 10.1.0.1", { "gw": "10.1.0.1" }, 5],
+			"operations": [{ "op": "flush", "match": { "dst": "10.0.0.0/8", "when": { "family": 4 } } }],
+			"profiles": { "a": { "match": { "namespace": "a" }, "locked": ["mode"] } },
+			"ipam": { "type": "static", "addresses": [] },
+			"args": { "cni": { "flushroutes": "yes" }, "k8s": {} }
+		}`), &conf)).To(Succeed())
+		Expect(testSchemaErrors(schema, schema, "", conf)).To(Equal([]string{
+			"addroutes[1]: matches 0 of oneOf",
+			"addroutes[2]: matches 0 of oneOf",
+			"args.cni.flushroutes: must be boolean",
+			"flushroute: unknown key",
+			"mode: must be one of [replace add]",
+			"operations[0].match.when: unknown key",
+			"profiles.a.locked[0]: must be one of [addroutes delroutes dryrun flushgateway flushroutes keeproutes routes rules skipcheck]",
+		}))
+	})
+})
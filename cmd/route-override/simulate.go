@@ -0,0 +1,226 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/vishvananda/netlink"
+)
+
+// ipJSONRoute is a route as printed by "ip -j route show table all"
+type ipJSONRoute struct {
+	Type     string `json:"type"`
+	Dst      string `json:"dst"`
+	Gateway  string `json:"gateway"`
+	Dev      string `json:"dev"`
+	Table    string `json:"table"`
+	Protocol string `json:"protocol"`
+	Scope    string `json:"scope"`
+	PrefSrc  string `json:"prefsrc"`
+	Metric   *int   `json:"metric"`
+	Pref     string `json:"pref"`
+}
+
+// kernelRoute converts the route, guessing the family of default routes
+// from the gateway or the IPv6-only "pref" attribute
+func (r *ipJSONRoute) kernelRoute() (*kernelRoute, error) {
+	route := &kernelRoute{
+		Dev:   r.Dev,
+		Table: syscall.RT_TABLE_MAIN,
+		Type:  syscall.RTN_UNICAST,
+	}
+
+	family := netlink.FAMILY_V4
+	if r.Gateway != "" {
+		route.Gw = net.ParseIP(r.Gateway)
+		if route.Gw == nil {
+			return nil, fmt.Errorf("invalid gateway %q", r.Gateway)
+		}
+		if route.Gw.To4() == nil {
+			family = netlink.FAMILY_V6
+		} else {
+			route.Gw = route.Gw.To4()
+		}
+	} else if r.Pref != "" || strings.Contains(r.Dst, ":") {
+		family = netlink.FAMILY_V6
+	}
+
+	dst, err := parseRouteDst(r.Dst, family)
+	if err != nil {
+		return nil, err
+	}
+	route.Dst = types.IPNet(*dst)
+
+	if r.PrefSrc != "" {
+		route.Src = net.ParseIP(r.PrefSrc)
+		if route.Src == nil {
+			return nil, fmt.Errorf("invalid prefsrc %q", r.PrefSrc)
+		}
+		if src4 := route.Src.To4(); src4 != nil {
+			route.Src = src4
+		}
+	}
+	if r.Table != "" {
+		if route.Table, err = parseIPRouteName("table", r.Table, ipRouteTables); err != nil {
+			return nil, err
+		}
+	}
+	if r.Protocol != "" {
+		if route.Protocol, err = parseIPRouteName("protocol", r.Protocol, ipRouteProtocols); err != nil {
+			return nil, err
+		}
+	}
+	if r.Type != "" {
+		if route.Type, err = parseIPRouteName("type", r.Type, ipRouteTypes); err != nil {
+			return nil, err
+		}
+	}
+	if r.Scope != "" {
+		scope, err := parseIPRouteName("scope", r.Scope, ipRouteScopes)
+		if err != nil {
+			return nil, err
+		}
+		route.Scope = netlink.Scope(scope)
+	}
+	if r.Metric != nil {
+		route.Priority = *r.Metric
+	}
+	return route, nil
+}
+
+// parseIPJSONRoutes parses the output of "ip -j route show table all"
+func parseIPJSONRoutes(data []byte) ([]*kernelRoute, error) {
+	ipRoutes := []*ipJSONRoute{}
+	if err := json.Unmarshal(data, &ipRoutes); err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %v", err)
+	}
+
+	routes := []*kernelRoute{}
+	for i, r := range ipRoutes {
+		route, err := r.kernelRoute()
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %v", i, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// visibleRoutes returns the routes that route-override sees in the netns,
+// i.e. the routes of all tables but the local table
+func visibleRoutes(routes []*kernelRoute) []*kernelRoute {
+	visible := []*kernelRoute{}
+	for _, route := range routes {
+		if route.Table != syscall.RT_TABLE_LOCAL {
+			visible = append(visible, route)
+		}
+	}
+	return visible
+}
+
+// runSimulate plans a configuration against a captured routing table and
+// prints the operations, the resulting routing table and the CNI result
+func runSimulate(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	confPath := flags.String("config", "", "plugin configuration with prevResult (JSON)")
+	ifName := flags.String("ifname", "", "container interface name (CNI_IFNAME)")
+	cniArgs := flags.String("args", "", "CNI_ARGS, e.g. \"K8S_POD_NAMESPACE=ns;K8S_POD_NAME=pod\"")
+	routesPaths := []string{}
+	flags.Func("routes", "routing table from \"ip -j route show table all\"; repeat for \"ip -j -6 route show table all\"", func(s string) error {
+		routesPaths = append(routesPaths, s)
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *confPath == "" || len(routesPaths) == 0 {
+		flags.Usage()
+		return fmt.Errorf("both --config and --routes are required")
+	}
+
+	data, err := os.ReadFile(*confPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+	if err := validateConf(data, *cniArgs); err != nil {
+		return err
+	}
+	conf, err := parseConf(data, *cniArgs)
+	if err != nil {
+		return err
+	}
+	if err := conf.loadRoutesFiles(); err != nil {
+		return err
+	}
+
+	routes := []*kernelRoute{}
+	for _, path := range routesPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read routes: %v", err)
+		}
+		r, err := parseIPJSONRoutes(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		routes = append(routes, r...)
+	}
+
+	ifNames, err := containerIfNames(conf.PrevResult, *ifName, routeLookup(routes))
+	if err != nil {
+		return err
+	}
+	plan, err := planRoutes(conf, ifNames, visibleRoutes(routes))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(stdout, "Operations:")
+	for _, op := range plan.Operations {
+		fmt.Fprintf(stdout, "  %v\n", op)
+	}
+	if len(plan.Warnings) > 0 {
+		fmt.Fprintln(stdout, "Warnings:")
+		for _, warning := range plan.Warnings {
+			fmt.Fprintf(stdout, "  %s\n", warning)
+		}
+	}
+
+	fmt.Fprintln(stdout, "Routing table:")
+	for _, route := range visibleRoutes(simulateOperations(routes, plan.Operations)) {
+		fmt.Fprintf(stdout, "  %v\n", route)
+	}
+
+	result, err := plan.Result.GetAsVersion(conf.CNIVersion)
+	if err != nil {
+		return fmt.Errorf("could not convert result to version %q: %v", conf.CNIVersion, err)
+	}
+	data, err = json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Result:\n%s\n", data)
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override simulate", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "route-override-simulate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		Expect(os.WriteFile(path, []byte(data), 0600)).To(Succeed())
+		return path
+	}
+
+	It("parses ip -j route output", func() {
+		routes, err := parseIPJSONRoutes([]byte(`[
+			{"dst":"default","gateway":"10.1.0.1","dev":"net1","flags":[]},
+			{"dst":"10.1.0.0/16","dev":"net1","protocol":"kernel","scope":"link","prefsrc":"10.1.0.5","flags":[]},
+			{"type":"local","dst":"10.1.0.5","dev":"net1","table":"local","protocol":"kernel","scope":"host","prefsrc":"10.1.0.5","flags":[]},
+			{"dst":"default","dev":"net1","protocol":"ra","metric":1024,"flags":[],"pref":"medium"},
+			{"dst":"fd00::/64","dev":"net1","table":"200","metric":256,"flags":[],"pref":"medium"}
+		]`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(routes)).To(Equal(5))
+		Expect(routes[0].String()).To(Equal("default via 10.1.0.1 dev net1"))
+		Expect(routes[1].String()).To(Equal("10.1.0.0/16 dev net1 src 10.1.0.5"))
+		Expect(routes[2].String()).To(Equal("10.1.0.5/32 dev net1 table 255 src 10.1.0.5"))
+		Expect(routes[3].String()).To(Equal("default dev net1 metric 1024"))
+		Expect(routes[3].Dst.IP.Equal(net.IPv6zero)).To(BeTrue())
+		Expect(routes[4].String()).To(Equal("fd00::/64 dev net1 table 200 metric 256"))
+
+		Expect(len(visibleRoutes(routes))).To(Equal(4))
+
+		_, err = parseIPJSONRoutes([]byte(`[{"dst":"10.1.0.0/16","dev":"net1","table":"custom"}]`))
+		Expect(err).To(MatchError(`route 0: unknown table "custom"`))
+	})
+
+	It("prints the plan, the routing table and the result", func() {
+		conf := writeFile("conf.json", `{
+			"cniVersion": "0.4.0",
+			"name": "test",
+			"type": "route-override",
+			"flushgateway": true,
+			"addroutes": [{"dst": "192.168.0.0/24", "gw": "10.1.254.254"}],
+			"prevResult": {
+				"cniVersion": "0.4.0",
+				"interfaces": [{"name": "net1", "sandbox": "/var/run/netns/test"}],
+				"ips": [{"version": "4", "address": "10.1.0.5/16", "gateway": "10.1.0.1", "interface": 0}],
+				"routes": [{"dst": "0.0.0.0/0"}]
+			}
+		}`)
+		routes := writeFile("routes.json", `[
+			{"dst":"default","gateway":"10.1.0.1","dev":"net1","flags":[]},
+			{"dst":"10.1.0.0/16","dev":"net1","protocol":"kernel","scope":"link","prefsrc":"10.1.0.5","flags":[]},
+			{"type":"local","dst":"10.1.0.5","dev":"net1","table":"local","protocol":"kernel","scope":"host","prefsrc":"10.1.0.5","flags":[]}
+		]`)
+
+		out := &bytes.Buffer{}
+		err := runSimulate([]string{"--config", conf, "--routes", routes}, out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.String()).To(HavePrefix(`Operations:
+  delete default via 10.1.0.1 dev net1
+  replace 192.168.0.0/24 via 10.1.254.254 dev net1
+Routing table:
+  10.1.0.0/16 dev net1 src 10.1.0.5
+  192.168.0.0/24 via 10.1.254.254 dev net1
+Result:
+`))
+		Expect(out.String()).To(ContainSubstring(`"gateway": "0.0.0.0"`))
+		Expect(out.String()).To(ContainSubstring(`"dst": "192.168.0.0/24"`))
+		Expect(out.String()).NotTo(ContainSubstring(`"dst": "0.0.0.0/0"`))
+	})
+
+	It("requires a config and a routing table", func() {
+		err := runSimulate([]string{}, &bytes.Buffer{})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,122 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+)
+
+// nodeConfigFile holds the node-level defaults of all configurations. It is
+// read on every ADD and CHECK if it exists.
+var nodeConfigFile = "/etc/cni/route-override/config.json"
+
+// nodeConfig are the settings of nodeConfigFile
+type nodeConfig struct {
+	Strict bool `json:"strict,omitempty"`
+}
+
+// loadNodeConfig reads nodeConfigFile, if any
+func loadNodeConfig() (*nodeConfig, error) {
+	node := &nodeConfig{}
+	data, err := os.ReadFile(nodeConfigFile)
+	if os.IsNotExist(err) {
+		return node, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", nodeConfigFile, err)
+	}
+	if err := json.Unmarshal(data, node); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", nodeConfigFile, err)
+	}
+	return node, nil
+}
+
+// strictMode returns the strict setting of the configuration, or the node
+// default if the configuration does not set it
+func strictMode(raw map[string]json.RawMessage) (bool, error) {
+	if value, ok := raw["strict"]; ok && string(value) != "null" {
+		var strict bool
+		if err := json.Unmarshal(value, &strict); err != nil {
+			return false, fmt.Errorf("invalid strict %s: must be a bool", value)
+		}
+		return strict, nil
+	}
+	node, err := loadNodeConfig()
+	if err != nil {
+		return false, err
+	}
+	return node.Strict, nil
+}
+
+// editDistance returns the Levenshtein distance of the strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// closestKey returns the known key that an unknown key is most likely a
+// typo of, or "" if none is close enough
+func closestKey(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", max(2, len(key)/3)+1
+	for _, known := range sortedFieldNames(fields) {
+		if d := editDistance(key, known); d < bestDistance {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+// sortedFieldNames returns the JSON keys in sorted order, so that ties
+// between suggestions are broken the same way every time
+func sortedFieldNames(fields map[string]reflect.Type) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unknownKey reports a key that the object does not have. Unknown keys are
+// problems in strict mode and warnings otherwise.
+func (v *validator) unknownKey(path, key string, fields map[string]reflect.Type) {
+	msg := joinPath(path, key) + ": unknown key"
+	if suggestion := closestKey(key, fields); suggestion != "" {
+		msg += fmt.Sprintf(", did you mean %q?", suggestion)
+	}
+	if v.strict {
+		v.problems = append(v.problems, msg)
+	} else {
+		v.warnings = append(v.warnings, msg)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override strict mode", func() {
+	var dir, saved string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "route-override-strict")
+		Expect(err).NotTo(HaveOccurred())
+		saved = nodeConfigFile
+		nodeConfigFile = filepath.Join(dir, "config.json")
+	})
+
+	AfterEach(func() {
+		nodeConfigFile = saved
+		os.RemoveAll(dir)
+	})
+
+	testConf := func(settings string) []byte {
+		return []byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"capabilities": { "routeOverride": true },
+			"ipam": { "type": "static", "addresses": [] },
+			"dns": { "nameservers": ["10.0.0.10"] },
+			"runtimeConfig": { "routeOverride": { "skipcheck": true }, "portMappings": [] },
+			"args": { "cni": { "dryrun": true, "addroute": [] }, "k8s": { "pod": "x" } },
+			` + settings + `
+			"flushroute": true,
+			"addroutes": ["10.1.0.0/16 via 10.0.0.1"]
+		}`)
+	}
+
+	It("only warns about unknown keys by default", func() {
+		Expect(validateConf(testConf(""), "")).To(Succeed())
+		Expect(validateConf(testConf(`"strict": false,`), "")).To(Succeed())
+	})
+
+	It("rejects unknown keys and allows the CNI envelope keys", func() {
+		problems := testProblems(validateConf(testConf(`"strict": true,`), ""))
+		Expect(problems).To(Equal([]string{
+			`args.cni.addroute: unknown key, did you mean "addroutes"?`,
+			`flushroute: unknown key, did you mean "flushroutes"?`,
+		}))
+	})
+
+	It("takes the default from the node configuration", func() {
+		Expect(os.WriteFile(nodeConfigFile, []byte(`{ "strict": true }`), 0644)).To(Succeed())
+		problems := testProblems(validateConf(testConf(""), ""))
+		Expect(problems).To(Equal([]string{
+			`args.cni.addroute: unknown key, did you mean "addroutes"?`,
+			`flushroute: unknown key, did you mean "flushroutes"?`,
+		}))
+
+		// the configuration overrides the node default
+		Expect(validateConf(testConf(`"strict": false,`), "")).To(Succeed())
+
+		Expect(os.WriteFile(nodeConfigFile, []byte(`{ "strict": `), 0644)).To(Succeed())
+		Expect(validateConf(testConf(""), "")).To(MatchError(ContainSubstring("failed to parse " + nodeConfigFile)))
+	})
+
+	It("suggests the closest key only if it is close enough", func() {
+		fields := jsonFields(reflect.TypeOf(RouteOverrideConfig{}))
+		Expect(closestKey("addroute", fields)).To(Equal("addroutes"))
+		Expect(closestKey("flushgw", fields)).To(Equal(""))
+		Expect(closestKey("protectedroute", fields)).To(Equal("protectedroutes"))
+		Expect(closestKey("color", fields)).To(Equal(""))
+		Expect(editDistance("kitten", "sitting")).To(Equal(3))
+	})
+})
@@ -0,0 +1,149 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// ipv6DefaultMetric is the metric that the kernel gives to IPv6 routes
+// added without one
+const ipv6DefaultMetric = 1024
+
+// routeTable indexes a routing table snapshot in memory, so that the plan
+// can be computed from a single dump regardless of the number of routes
+type routeTable struct {
+	routes []*kernelRoute
+	byDev  map[string][]*kernelRoute
+	byDst  map[string][]*kernelRoute
+}
+
+// newRouteTable indexes the given routes by device and by destination
+func newRouteTable(routes []*kernelRoute) *routeTable {
+	t := &routeTable{
+		routes: routes,
+		byDev:  map[string][]*kernelRoute{},
+		byDst:  map[string][]*kernelRoute{},
+	}
+	for _, route := range routes {
+		t.byDev[route.Dev] = append(t.byDev[route.Dev], route)
+		key := dstKey((*net.IPNet)(&route.Dst))
+		t.byDst[key] = append(t.byDst[key], route)
+	}
+	return t
+}
+
+// dstKey returns the index key of a destination
+func dstKey(dst *net.IPNet) string {
+	return dst.String()
+}
+
+// devRoutes returns the routes of the given devices
+func (t *routeTable) devRoutes(devs []string) []*kernelRoute {
+	routes := []*kernelRoute{}
+	for _, dev := range devs {
+		routes = append(routes, t.byDev[dev]...)
+	}
+	return routes
+}
+
+// dstRoutes returns the routes to dst on the given devices
+func (t *routeTable) dstRoutes(dst *net.IPNet, devs []string) []*kernelRoute {
+	routes := []*kernelRoute{}
+	for _, route := range t.byDst[dstKey(dst)] {
+		for _, dev := range devs {
+			if route.Dev == dev {
+				routes = append(routes, route)
+				break
+			}
+		}
+	}
+	return routes
+}
+
+// simulateOperations applies the operations to the routing table snapshot
+// the way the kernel would
+func simulateOperations(routes []*kernelRoute, ops []*routeOperation) []*kernelRoute {
+	table := append([]*kernelRoute{}, routes...)
+	for _, op := range ops {
+		// rules do not change the routing table
+		if op.Route == nil {
+			continue
+		}
+		route := op.kernelRoute()
+
+		kept := table[:0]
+		for _, r := range table {
+			if !op.removes(route, r) {
+				kept = append(kept, r)
+			}
+		}
+		table = kept
+		if op.Action != opDelete {
+			table = append(table, route)
+		}
+	}
+	return table
+}
+
+// recordReplaced records in each replace operation the route that it
+// overwrites, given the routes before the operations
+func recordReplaced(routes []*kernelRoute, ops []*routeOperation) {
+	table := routes
+	for _, op := range ops {
+		if op.Action == opReplace && op.Route != nil {
+			route := op.kernelRoute()
+			for _, r := range table {
+				if op.removes(route, r) {
+					op.Replaced = r
+					break
+				}
+			}
+		}
+		table = simulateOperations(table, []*routeOperation{op})
+	}
+}
+
+// kernelRoute returns the route of the operation with the defaults that
+// the kernel fills in
+func (op *routeOperation) kernelRoute() *kernelRoute {
+	route := *op.Route
+	if route.Table == 0 {
+		route.Table = syscall.RT_TABLE_MAIN
+	}
+	if route.Type == 0 {
+		route.Type = syscall.RTN_UNICAST
+	}
+	if route.Priority == 0 && route.Dst.IP.To4() == nil {
+		// IPv6 routes get the kernel's default metric
+		route.Priority = ipv6DefaultMetric
+	}
+	return &route
+}
+
+// removes returns true if applying the operation, whose route is given as
+// returned by kernelRoute, removes the route r from the routing table
+func (op *routeOperation) removes(route, r *kernelRoute) bool {
+	switch op.Action {
+	case opDelete:
+		return r.String() == route.String()
+	case opReplace:
+		// the kernel replaces the route with the same key
+		return r.Table == route.Table && r.Priority == route.Priority &&
+			dstKey((*net.IPNet)(&r.Dst)) == dstKey((*net.IPNet)(&route.Dst))
+	}
+	return false
+}
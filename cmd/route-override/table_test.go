@@ -0,0 +1,170 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	"github.com/vishvananda/netlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override route table", func() {
+	It("indexes routes by device and destination", func() {
+		table := newRouteTable([]*kernelRoute{
+			testJournalRoute("30.0.0.0/24", "10.0.0.1"),
+			testJournalRoute("20.0.0.0/24", "10.0.0.1"),
+			{Dev: "eth0", Dst: testJournalRoute("20.0.0.0/24", "").Dst},
+		})
+
+		Expect(len(table.devRoutes([]string{"dummy0"}))).To(Equal(2))
+		Expect(len(table.devRoutes([]string{"dummy0", "eth0"}))).To(Equal(3))
+
+		_, dst, _ := net.ParseCIDR("20.0.0.0/24")
+		Expect(len(table.dstRoutes(dst, []string{"dummy0"}))).To(Equal(1))
+		Expect(len(table.dstRoutes(dst, []string{"dummy0", "eth0"}))).To(Equal(2))
+		Expect(len(table.dstRoutes(dst, []string{"net1"}))).To(Equal(0))
+	})
+})
+
+const (
+	benchTableSize = 10000
+	benchDelRoutes = 1000
+)
+
+// benchRouteTable creates a netns with benchTableSize routes on dummy0 and
+// returns it with benchDelRoutes of them as delroutes
+func benchRouteTable(b *testing.B) (ns.NetNS, []*RouteEntry) {
+	if os.Geteuid() != 0 {
+		b.Skip("requires root")
+	}
+
+	targetNS, err := testutils.NewNS()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	delRoutes := []*RouteEntry{}
+	err = targetNS.Do(func(ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dummy0"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("dummy0")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+		if err := testAddAddr(link, net.IPv4(10, 0, 0, 2), net.CIDRMask(24, 32)); err != nil {
+			return err
+		}
+		for i := 0; i < benchTableSize; i++ {
+			ip := net.IPv4(100, byte(i>>8), byte(i), 0)
+			if err := testAddRoute(link, ip, net.CIDRMask(24, 32), net.IPv4(10, 0, 0, 1)); err != nil {
+				return err
+			}
+			if i%(benchTableSize/benchDelRoutes) == 0 {
+				delRoutes = append(delRoutes, &RouteEntry{Dst: net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return targetNS, delRoutes
+}
+
+// BenchmarkPlanDelRoutesPerEntryDump plans delroutes the way route-override
+// did before the routing table was indexed: one link lookup and one route
+// dump per delroutes entry
+func BenchmarkPlanDelRoutesPerEntryDump(b *testing.B) {
+	targetNS, delRoutes := benchRouteTable(b)
+	defer targetNS.Close()
+
+	b.ResetTimer()
+	err := targetNS.Do(func(ns.NetNS) error {
+		for n := 0; n < b.N; n++ {
+			ops := 0
+			for _, route := range delRoutes {
+				link, err := netlink.LinkByName("dummy0")
+				if err != nil {
+					return err
+				}
+				nlroutes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+				if err != nil {
+					return err
+				}
+				for _, nlroute := range nlroutes {
+					if nlroute.Dst != nil &&
+						nlroute.Dst.IP.Equal(route.Dst.IP) &&
+						nlroute.Dst.Mask.String() == route.Dst.Mask.String() {
+						ops++
+					}
+				}
+			}
+			if ops != len(delRoutes) {
+				b.Fatalf("planned %d deletions, expected %d", ops, len(delRoutes))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkPlanDelRoutes plans the same delroutes from a single dump
+func BenchmarkPlanDelRoutes(b *testing.B) {
+	targetNS, delRoutes := benchRouteTable(b)
+	defer targetNS.Close()
+
+	ifNames := []string{"dummy0"}
+
+	b.ResetTimer()
+	err := targetNS.Do(func(ns.NetNS) error {
+		return withKernel(func(k *kernel) error {
+			for n := 0; n < b.N; n++ {
+				routes, err := k.dumpRoutes()
+				if err != nil {
+					return err
+				}
+				table := newRouteTable(routes)
+				ops := []*routeOperation{}
+				for _, route := range delRoutes {
+					ops = append(ops, deleteRoute(table, route, ifNames)...)
+				}
+				ops = uniqueOperations(ops)
+				if len(ops) != len(delRoutes) {
+					b.Fatalf("planned %d deletions, expected %d", len(ops), len(delRoutes))
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
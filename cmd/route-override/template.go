@@ -0,0 +1,224 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"text/template"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// routeTemplateFuncs are the functions available in route templates
+var routeTemplateFuncs = template.FuncMap{
+	"host": templateHost,
+}
+
+// templateHost returns the n-th address of the subnet, as in
+// {{.Subnet4 | host 1}}
+func templateHost(n int, subnet string) (string, error) {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid subnet %q", subnet)
+	}
+	ip := ipnet.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	addr := new(big.Int).Add(new(big.Int).SetBytes(ip), big.NewInt(int64(n)))
+	if n < 0 || len(addr.Bytes()) > len(ip) {
+		return "", fmt.Errorf("host %d is outside of %s", n, subnet)
+	}
+	host := net.IP(addr.FillBytes(make([]byte, len(ip))))
+	if !ipnet.Contains(host) {
+		return "", fmt.Errorf("host %d is outside of %s", n, subnet)
+	}
+	return host.String(), nil
+}
+
+// parseRouteTemplate parses the JSON text of a route entry as template
+func parseRouteTemplate(raw string) (*template.Template, error) {
+	return template.New("route").Funcs(routeTemplateFuncs).Option("missingkey=error").Parse(raw)
+}
+
+// routeTemplateData is what a route template can refer to: the addresses
+// of one container interface in the CNI result
+type routeTemplateData struct {
+	Interface string
+	ips       []*current.IPConfig
+}
+
+// newRouteTemplateData collects the addresses of the interface. Addresses
+// that refer to no interface belong to every interface.
+func newRouteTemplateData(res *current.Result, ifName string) *routeTemplateData {
+	data := &routeTemplateData{Interface: ifName}
+	for _, ip := range res.IPs {
+		if ip.Interface == nil || *ip.Interface < 0 || *ip.Interface >= len(res.Interfaces) ||
+			res.Interfaces[*ip.Interface].Name == ifName {
+			data.ips = append(data.ips, ip)
+		}
+	}
+	return data
+}
+
+// ip returns the first address of the family
+func (d *routeTemplateData) ip(v6 bool) *current.IPConfig {
+	for _, ip := range d.ips {
+		if (ip.Address.IP.To4() == nil) == v6 {
+			return ip
+		}
+	}
+	return nil
+}
+
+func (d *routeTemplateData) address(v6 bool) (string, error) {
+	ip := d.ip(v6)
+	if ip == nil {
+		return "", fmt.Errorf("no IPv%s address for %s in prevResult", ipVersion(v6), d.Interface)
+	}
+	return ip.Address.IP.String(), nil
+}
+
+func (d *routeTemplateData) gateway(v6 bool) (string, error) {
+	ip := d.ip(v6)
+	if ip == nil || ip.Gateway == nil || ip.Gateway.IsUnspecified() {
+		return "", fmt.Errorf("no IPv%s gateway for %s in prevResult", ipVersion(v6), d.Interface)
+	}
+	return ip.Gateway.String(), nil
+}
+
+func (d *routeTemplateData) subnet(v6 bool) (string, error) {
+	ip := d.ip(v6)
+	if ip == nil {
+		return "", fmt.Errorf("no IPv%s address for %s in prevResult", ipVersion(v6), d.Interface)
+	}
+	subnet := net.IPNet{IP: ip.Address.IP.Mask(ip.Address.Mask), Mask: ip.Address.Mask}
+	return subnet.String(), nil
+}
+
+func ipVersion(v6 bool) string {
+	if v6 {
+		return "6"
+	}
+	return "4"
+}
+
+// IP4 is the IPv4 address of the interface
+func (d *routeTemplateData) IP4() (string, error) { return d.address(false) }
+
+// IP6 is the IPv6 address of the interface
+func (d *routeTemplateData) IP6() (string, error) { return d.address(true) }
+
+// Gateway4 is the IPv4 gateway of the interface
+func (d *routeTemplateData) Gateway4() (string, error) { return d.gateway(false) }
+
+// Gateway6 is the IPv6 gateway of the interface
+func (d *routeTemplateData) Gateway6() (string, error) { return d.gateway(true) }
+
+// Subnet4 is the IPv4 subnet of the interface
+func (d *routeTemplateData) Subnet4() (string, error) { return d.subnet(false) }
+
+// Subnet6 is the IPv6 subnet of the interface
+func (d *routeTemplateData) Subnet6() (string, error) { return d.subnet(true) }
+
+// isTemplate returns true if the JSON text of a route entry has template
+// actions
+func isTemplate(raw []byte) bool {
+	return bytes.Contains(raw, []byte("{{"))
+}
+
+// newTemplateEntry returns a route entry that is parsed once its template
+// is resolved
+func newTemplateEntry(raw []byte) (*RouteEntry, error) {
+	if _, err := parseRouteTemplate(string(raw)); err != nil {
+		return nil, fmt.Errorf("invalid route template %s: %v", raw, err)
+	}
+	return &RouteEntry{template: string(raw)}, nil
+}
+
+// templateDev returns the device that a route template names, unless the
+// device is a template itself
+func templateDev(raw string) string {
+	var text string
+	if err := json.Unmarshal([]byte(raw), &text); err == nil {
+		fields := strings.Fields(text)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "dev" && !isTemplate([]byte(fields[i+1])) {
+				return fields[i+1]
+			}
+		}
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "via" {
+				return gatewayZone(fields[i+1])
+			}
+		}
+		return ""
+	}
+	obj := routeEntryJSON{}
+	if err := json.Unmarshal([]byte(raw), &obj); err == nil {
+		if obj.Dev != "" && !isTemplate([]byte(obj.Dev)) {
+			return obj.Dev
+		}
+		return gatewayZone(obj.GW)
+	}
+	return ""
+}
+
+// gatewayZone returns the device that a gateway names as zone, unless the
+// device is a template
+func gatewayZone(gw string) string {
+	if _, zone, ok := strings.Cut(gw, "%"); ok && !isTemplate([]byte(zone)) {
+		return zone
+	}
+	return ""
+}
+
+// resolveTemplate returns the route entry with its template executed for
+// the interface of the route, or for ifName if the route has no device
+func (r *RouteEntry) resolveTemplate(res *current.Result, ifName string) (*RouteEntry, error) {
+	if r.template == "" {
+		return r, nil
+	}
+	if res == nil {
+		return nil, fmt.Errorf("cannot resolve route template %s: prevResult missing", r.template)
+	}
+	tmpl, err := parseRouteTemplate(r.template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route template %s: %v", r.template, err)
+	}
+
+	// the device selects the addresses
+	if dev := templateDev(r.template); dev != "" {
+		ifName = dev
+	}
+
+	out := &bytes.Buffer{}
+	if err := tmpl.Execute(out, newRouteTemplateData(res, ifName)); err != nil {
+		return nil, fmt.Errorf("cannot resolve route template %s: %v", r.template, err)
+	}
+	if isTemplate(out.Bytes()) {
+		return nil, fmt.Errorf("cannot resolve route template %s: result %s is a template", r.template, out.Bytes())
+	}
+	entry := &RouteEntry{}
+	if err := json.Unmarshal(out.Bytes(), entry); err != nil {
+		return nil, fmt.Errorf("route template %s: %v", r.template, err)
+	}
+	return entry, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override route templates", func() {
+	prevResult := `"prevResult": {
+		"cniVersion": "0.3.1",
+		"interfaces": [
+			{ "name": "net0", "sandbox": "netns" },
+			{ "name": "net1", "sandbox": "netns" }
+		],
+		"ips": [
+			{ "version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0 },
+			{ "version": "4", "address": "10.1.0.2/24", "gateway": "10.1.0.1", "interface": 1 },
+			{ "version": "6", "address": "fd00:1::2/64", "interface": 1 }
+		]
+	}`
+	ifNames := []string{"net0", "net1"}
+
+	It("resolves the addresses of the first interface", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": [
+				"default via {{.Gateway4}} src {{.IP4}} metric 50",
+				{ "dst": "192.168.0.0/16", "gw": "{{.Subnet4 | host 254}}" },
+				"{{.Subnet6}} via {{.Subnet6 | host 1}} dev net1",
+				"fd01::/64 via fe80::1%net1 src {{.IP6}}",
+				"default dev net1 src {{.IP6}} table 100"
+			],
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, ifNames, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"replace default via 10.0.0.1 dev net0 metric 50 src 10.0.0.2",
+			"replace 192.168.0.0/16 via 10.0.0.254 dev net0",
+			"replace fd00:1::/64 via fd00:1::1 dev net1",
+			"replace fd01::/64 via fe80::1 dev net1 src fd00:1::2",
+			"replace default dev net1 table 100 src fd00:1::2",
+		}))
+		Expect(plan.Operations[4].Route.Dst.IP.To4()).To(BeNil())
+	})
+
+	It("resolves the routes of interfaces entries per interface", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"interfaces": {
+				"net*": { "addroutes": ["10.100.0.0/16 via {{.Gateway4}}"] }
+			},
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, ifNames, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"replace 10.100.0.0/16 via 10.0.0.1 dev net0",
+			"replace 10.100.0.0/16 via 10.1.0.1 dev net1",
+		}))
+
+		// the configuration keeps the templates
+		Expect(conf.Interfaces["net*"].AddRoutes[0].String()).To(Equal(`"10.100.0.0/16 via {{.Gateway4}}"`))
+	})
+
+	It("rejects templates that cannot be resolved", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": ["default via {{.Gateway6}}"],
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = planRoutes(conf, ifNames, nil)
+		Expect(err).To(MatchError(ContainSubstring("no IPv6 gateway for net0 in prevResult")))
+
+		conf, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": ["default via {{.Router}}"],
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = planRoutes(conf, ifNames, nil)
+		Expect(err).To(MatchError(ContainSubstring("can't evaluate field Router")))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": ["default via {{.Gateway4"]
+		}`), "")
+		Expect(err).To(MatchError(ContainSubstring("invalid route template")))
+	})
+
+	It("computes host addresses of a subnet", func() {
+		Expect(templateHost(1, "10.0.0.0/24")).To(Equal("10.0.0.1"))
+		Expect(templateHost(255, "10.0.0.0/24")).To(Equal("10.0.0.255"))
+		Expect(templateHost(1, "fd00:1::/64")).To(Equal("fd00:1::1"))
+
+		_, err := templateHost(256, "10.0.0.0/24")
+		Expect(err).To(MatchError("host 256 is outside of 10.0.0.0/24"))
+		_, err = templateHost(-1, "10.0.0.0/24")
+		Expect(err).To(MatchError("host -1 is outside of 10.0.0.0/24"))
+	})
+})
@@ -0,0 +1,411 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// jsonForms are the types whose JSON object form is another type
+var jsonForms = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(RouteEntry{}): reflect.TypeOf(routeEntryJSON{}),
+	reflect.TypeOf(routeMatch{}): reflect.TypeOf(routeEntryJSON{}),
+	reflect.TypeOf(kernelRule{}): reflect.TypeOf(kernelRule{}),
+}
+
+// openObjects are the paths of objects that may have keys of other
+// plugins or conventions. Their known keys are still checked.
+var openObjects = map[string]bool{
+	"args":          true,
+	"ipam":          true,
+	"runtimeConfig": true,
+}
+
+// routeListKeys are the keys of route lists, and whether their routes are
+// installed
+var routeListKeys = []struct {
+	key     string
+	install bool
+}{
+	{"delroutes", false},
+	{"addroutes", true},
+	{"keeproutes", false},
+	{"routes", true},
+	{"protectedroutes", false},
+}
+
+// validator collects the problems of a configuration
+type validator struct {
+	prevResult *current.Result
+	strict     bool
+	problems   []string
+	warnings   []string
+}
+
+func (v *validator) problem(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// joinPath appends a key to a JSON path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// jsonFields returns the types of the JSON keys of a struct, including
+// those of embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			for key, ft := range jsonFields(f.Type) {
+				fields[key] = ft
+			}
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		fields[tag] = f.Type
+	}
+	return fields
+}
+
+// sortedKeys returns the keys of the object in sorted order, so that the
+// problems are reported in a stable order
+func sortedKeys(obj map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unknownKeys reports the object keys in data that the type does not have
+func (v *validator) unknownKeys(path string, data json.RawMessage, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if form, ok := jsonForms[t]; ok {
+		t = form
+	} else if reflect.PtrTo(t).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) {
+		return
+	}
+	// checkProfiles knows the keys of profiles
+	if path == "profiles" {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj := map[string]json.RawMessage{}
+		if json.Unmarshal(data, &obj) != nil {
+			return
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(obj) {
+			ft, ok := fields[key]
+			if !ok {
+				if !openObjects[path] {
+					v.unknownKey(path, key, fields)
+				}
+				continue
+			}
+			v.unknownKeys(joinPath(path, key), obj[key], ft)
+		}
+	case reflect.Slice:
+		list := []json.RawMessage{}
+		if json.Unmarshal(data, &list) != nil {
+			return
+		}
+		for i, elem := range list {
+			v.unknownKeys(fmt.Sprintf("%s[%d]", path, i), elem, t.Elem())
+		}
+	case reflect.Map:
+		obj := map[string]json.RawMessage{}
+		if json.Unmarshal(data, &obj) != nil {
+			return
+		}
+		for _, key := range sortedKeys(obj) {
+			v.unknownKeys(joinPath(path, key), obj[key], t.Elem())
+		}
+	}
+}
+
+// routeList decodes each entry of a route list. Entries that cannot be
+// decoded are reported and left nil.
+func (v *validator) routeList(path string, data json.RawMessage) []*RouteEntry {
+	list := []json.RawMessage{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		v.problem(path, "must be a list of routes")
+		return nil
+	}
+	entries := make([]*RouteEntry, len(list))
+	for i, elem := range list {
+		entry := &RouteEntry{}
+		if err := json.Unmarshal(elem, entry); err != nil {
+			v.problem(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+			continue
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// ruleList decodes each entry of a rule list and reports the entries that
+// cannot be decoded
+func (v *validator) ruleList(path string, data json.RawMessage) {
+	list := []json.RawMessage{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		v.problem(path, "must be a list of rules")
+		return
+	}
+	for i, elem := range list {
+		if err := json.Unmarshal(elem, &kernelRule{}); err != nil {
+			v.problem(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+// checked returns true for entries whose values are known before ADD
+func checked(entry *RouteEntry) bool {
+	return entry != nil && entry.template == "" && entry.When == nil
+}
+
+// checkFamilies reports addresses of a route that differ in family from
+// its destination
+func (v *validator) checkFamilies(path string, entry *RouteEntry) {
+	v4 := entry.Dst.IP.To4() != nil
+	if entry.GW != nil && (entry.GW.To4() != nil) != v4 {
+		v.problem(path, "gw %v and dst %v are of different address families", entry.GW, entry.Dst.String())
+	}
+	if entry.Src != nil && (entry.Src.To4() != nil) != v4 {
+		v.problem(path, "src %v and dst %v are of different address families", entry.Src, entry.Dst.String())
+	}
+}
+
+// checkGateway reports gateways outside of the prevResult subnets and of
+// the link routes of the list
+func (v *validator) checkGateway(path string, entry *RouteEntry, list []*RouteEntry) {
+	if entry.GW == nil || v.prevResult == nil || entry.GW.IsLinkLocalUnicast() {
+		return
+	}
+	onResult := entry.Dev == ""
+	for _, ip := range v.prevResult.IPs {
+		if entry.Dev != "" && ip.Interface != nil && *ip.Interface >= 0 && *ip.Interface < len(v.prevResult.Interfaces) &&
+			v.prevResult.Interfaces[*ip.Interface].Name == entry.Dev {
+			onResult = true
+		}
+		if ip.Address.Contains(entry.GW) {
+			return
+		}
+	}
+	// devices outside of prevResult may have other addresses
+	if !onResult {
+		return
+	}
+	for _, other := range list {
+		if checked(other) && other.GW == nil && other.Dst.Contains(entry.GW) {
+			return
+		}
+	}
+	v.problem(path, "gw %v is not reachable from any prevResult subnet", entry.GW)
+}
+
+// routeScope checks the route and rule lists of an object: the top level, args,
+// runtimeConfig and the entries of interfaces and profiles
+func (v *validator) routeScope(path string, obj map[string]json.RawMessage) {
+	lists := map[string][]*RouteEntry{}
+	for _, l := range routeListKeys {
+		raw, ok := obj[l.key]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		listPath := joinPath(path, l.key)
+		entries := v.routeList(listPath, raw)
+		lists[l.key] = entries
+
+		seen := map[string]int{}
+		for i, entry := range entries {
+			if !checked(entry) {
+				continue
+			}
+			entryPath := fmt.Sprintf("%s[%d]", listPath, i)
+			v.checkFamilies(entryPath, entry)
+
+			// installed routes are the same if the kernel replaces one by
+			// the other
+			key := entry.String()
+			if l.install {
+				key = fmt.Sprintf("%s %d %d", entry.Dst.String(), entry.table(), entry.Metric)
+				v.checkGateway(entryPath, entry, entries)
+			}
+			if j, ok := seen[key]; ok {
+				v.problem(entryPath, "duplicate of %s[%d]", listPath, j)
+				continue
+			}
+			seen[key] = i
+		}
+	}
+
+	if raw, ok := obj["rules"]; ok && string(raw) != "null" {
+		v.ruleList(joinPath(path, "rules"), raw)
+	}
+
+	for i, add := range lists["addroutes"] {
+		if !checked(add) {
+			continue
+		}
+		for j, del := range lists["delroutes"] {
+			if checked(del) && dstKey(&del.Dst) == dstKey(&add.Dst) && del.table() == add.table() {
+				v.problem(fmt.Sprintf("%s[%d]", joinPath(path, "addroutes"), i),
+					"%v is also in %s[%d]", add.Dst.String(), joinPath(path, "delroutes"), j)
+				break
+			}
+		}
+	}
+}
+
+// object decodes the JSON object at the key, if any
+func object(obj map[string]json.RawMessage, key string) map[string]json.RawMessage {
+	sub := map[string]json.RawMessage{}
+	if raw, ok := obj[key]; !ok || json.Unmarshal(raw, &sub) != nil {
+		return nil
+	}
+	return sub
+}
+
+// checkProfiles reports the unknown keys of the profiles and checks their
+// route lists
+func (v *validator) checkProfiles(profiles map[string]json.RawMessage) {
+	fields := jsonFields(reflect.TypeOf(RouteOverrideConfig{}))
+	fields["match"] = reflect.TypeOf(profileMatch{})
+	fields["when"] = reflect.TypeOf(RouteCondition{})
+	for _, name := range sortedKeys(profiles) {
+		path := joinPath("profiles", name)
+		profile := object(profiles, name)
+		for _, key := range sortedKeys(profile) {
+			ft, ok := fields[key]
+			if !ok {
+				v.unknownKey(path, key, fields)
+				continue
+			}
+			v.unknownKeys(joinPath(path, key), profile[key], ft)
+		}
+		v.routeScope(path, profile)
+	}
+}
+
+// checkOperations checks the routes of the operations pipeline
+func (v *validator) checkOperations(data json.RawMessage) {
+	steps := []map[string]json.RawMessage{}
+	if json.Unmarshal(data, &steps) != nil {
+		return
+	}
+	for i, step := range steps {
+		raw, ok := step["route"]
+		if !ok {
+			continue
+		}
+		path := fmt.Sprintf("operations[%d].route", i)
+		entry := &RouteEntry{}
+		if err := json.Unmarshal(raw, entry); err != nil {
+			v.problem(path, "%v", err)
+			continue
+		}
+		if checked(entry) {
+			v.checkFamilies(path, entry)
+			if op := string(step["op"]); op != `"`+stepDelete+`"` {
+				v.checkGateway(path, entry, nil)
+			}
+		}
+	}
+}
+
+// validateConf checks the configuration, as selected by the CNI_ARGS,
+// before any netns is entered. It reports all problems at once, each with
+// the JSON path of the offending value. Unknown keys are only problems in
+// strict mode, otherwise they are printed as warnings.
+func validateConf(data []byte, envArgs string) error {
+	data, err := applyProfile(data, parseCNIArgs(envArgs))
+	if err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	v := &validator{}
+	if v.strict, err = strictMode(raw); err != nil {
+		return err
+	}
+	if rawPrevResult, ok := raw["prevResult"]; ok {
+		var cniVersion string
+		_ = json.Unmarshal(raw["cniVersion"], &cniVersion)
+		// parseConf reports a prevResult that cannot be parsed
+		v.prevResult, _ = parsePrevResult(cniVersion, rawPrevResult)
+	}
+
+	v.unknownKeys("", data, reflect.TypeOf(RouteOverrideConfig{}))
+	v.routeScope("", raw)
+	if argsObj := object(raw, "args"); argsObj != nil {
+		if cni := object(argsObj, "cni"); cni != nil {
+			v.routeScope("args.cni", cni)
+		}
+	}
+	if runtimeConfig := object(raw, "runtimeConfig"); runtimeConfig != nil {
+		if routeOverride := object(runtimeConfig, "routeOverride"); routeOverride != nil {
+			v.routeScope("runtimeConfig.routeOverride", routeOverride)
+		}
+	}
+	if interfaces := object(raw, "interfaces"); interfaces != nil {
+		for _, key := range sortedKeys(interfaces) {
+			if ifConf := object(interfaces, key); ifConf != nil {
+				v.routeScope(joinPath("interfaces", key), ifConf)
+			}
+		}
+	}
+	if profiles := object(raw, "profiles"); profiles != nil {
+		v.checkProfiles(profiles)
+	}
+	if operations, ok := raw["operations"]; ok {
+		v.checkOperations(operations)
+	}
+
+	for _, warning := range v.warnings {
+		fmt.Fprintf(os.Stderr, "route-override: %s\n", warning)
+	}
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return types.NewError(types.ErrInvalidNetworkConfig, "invalid route-override configuration", strings.Join(v.problems, "; "))
+}
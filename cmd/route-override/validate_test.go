@@ -0,0 +1,157 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testProblems returns the problems reported by validateConf
+func testProblems(err error) []string {
+	Expect(err).To(HaveOccurred())
+	cniErr, ok := err.(*types.Error)
+	Expect(ok).To(BeTrue())
+	Expect(cniErr.Code).To(Equal(uint(types.ErrInvalidNetworkConfig)))
+	Expect(cniErr.Msg).To(Equal("invalid route-override configuration"))
+	return strings.Split(cniErr.Details, "; ")
+}
+
+var _ = Describe("route-override configuration validation", func() {
+	prevResult := `"prevResult": {
+		"cniVersion": "0.3.1",
+		"interfaces": [{ "name": "net1", "sandbox": "netns" }],
+		"ips": [
+			{ "version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0 },
+			{ "version": "6", "address": "fd00::2/64", "gateway": "fd00::1", "interface": 0 }
+		]
+	}`
+
+	It("accepts a valid configuration", func() {
+		Expect(validateConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"ipam": { "type": "static", "addresses": [] },
+			"flushgateway": true,
+			"delroutes": ["30.0.0.0/24", { "dst": "40.0.0.0/24", "gw": "10.0.0.254" }],
+			"addroutes": [
+				"192.168.0.0/24 dev net1",
+				"172.16.0.0/16 via 192.168.0.1",
+				"fd01::/64 via fd00::1",
+				"default via {{.Gateway4}} table 100",
+				"50.0.0.0/24 via 10.9.0.1 dev eth0"
+			],
+			"args": { "cni": { "skipcheck": true }, "k8s": { "pod": "x" } },
+			`+prevResult+`
+		}`), "")).To(Succeed())
+	})
+
+	It("reports every problem with its path", func() {
+		problems := testProblems(validateConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"strict": true,
+			"flushroute": true,
+			"delroutes": ["30.0.0.0/24", "30.0.0.0/24", { "gw": "10.0.0.1" }],
+			"addroutes": [
+				"30.0.0.0/24 via 10.0.0.254",
+				"40.0.0.0/24 via fd00::1",
+				{ "dst": "50.0.0.0/24", "gw": "10.5.0.1", "gateway": "10.5.0.1" },
+				"60.0.0.0/24 via 10.0.0.254 metric 10",
+				"60.0.0.0/24 via 10.0.0.253 metric 10"
+			],
+			"interfaces": { "net1": { "flushroutes": true, "keeproute": [] } },
+			"args": { "cni": { "addroutes": ["default via 10.6.0.1"], "dryrun": true, "debug": true } },
+			"profiles": { "tenant": { "match": { "namespace": "a" }, "addroute": [] } },
+			`+prevResult+`
+		}`), ""))
+		Expect(problems).To(Equal([]string{
+			"addroutes[2].gateway: unknown key",
+			"args.cni.debug: unknown key",
+			`flushroute: unknown key, did you mean "flushroutes"?`,
+			`interfaces.net1.keeproute: unknown key, did you mean "keeproutes"?`,
+			`delroutes[2]: invalid route { "gw": "10.0.0.1" }: missing "dst"`,
+			"delroutes[1]: duplicate of delroutes[0]",
+			"addroutes[1]: gw fd00::1 and dst 40.0.0.0/24 are of different address families",
+			"addroutes[2]: gw 10.5.0.1 is not reachable from any prevResult subnet",
+			"addroutes[4]: duplicate of addroutes[3]",
+			"addroutes[0]: 30.0.0.0/24 is also in delroutes[0]",
+			"args.cni.addroutes[0]: gw 10.6.0.1 is not reachable from any prevResult subnet",
+			`profiles.tenant.addroute: unknown key, did you mean "addroutes"?`,
+		}))
+	})
+
+	It("reports invalid rules", func() {
+		problems := testProblems(validateConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"rules": [null, "from 10.0.0.0/24 table 100"],
+			"args": { "cni": { "rules": ["from 10.0.0.0/24"] } }
+		}`), ""))
+		Expect(problems).To(Equal([]string{
+			"rules[0]: invalid rule null: missing table",
+			`args.cni.rules[0]: invalid rule "from 10.0.0.0/24": missing table`,
+		}))
+	})
+
+	It("reports problems of operations", func() {
+		problems := testProblems(validateConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"strict": true,
+			"operations": [
+				{ "op": "flush", "match": { "dst": "10.0.0.0/8", "metric": 5, "color": "red" } },
+				{ "op": "delete", "route": "30.0.0.0/24 via 10.7.0.1" },
+				{ "op": "add", "route": "40.0.0.0/24 via 10.7.0.1" },
+				{ "op": "replace", "route": "40.0.0.0/24 via fd00::1" }
+			],
+			`+prevResult+`
+		}`), ""))
+		Expect(problems).To(Equal([]string{
+			"operations[0].match.color: unknown key",
+			"operations[2].route: gw 10.7.0.1 is not reachable from any prevResult subnet",
+			"operations[3].route: gw fd00::1 and dst 40.0.0.0/24 are of different address families",
+		}))
+	})
+
+	It("fails ADD before entering the netns", func() {
+		err := cmdAdd(&skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/nonexistent/netns",
+			IfName:      "net1",
+			StdinData: []byte(`{
+				"name": "test",
+				"type": "route-override",
+				"cniVersion": "0.3.1",
+				"addroutes": ["40.0.0.0/24 via 10.7.0.1"],
+				` + prevResult + `
+			}`),
+		})
+		Expect(testProblems(err)).To(Equal([]string{
+			"addroutes[0]: gw 10.7.0.1 is not reachable from any prevResult subnet",
+		}))
+	})
+})
@@ -0,0 +1,125 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// RouteCondition restricts a route entry or a profile to the attachments
+// it fits. All conditions that are set must hold.
+type RouteCondition struct {
+	IPIn   *types.IPNet `json:"ipIn,omitempty"`
+	IfName string       `json:"ifname,omitempty"`
+	Family int          `json:"family,omitempty"`
+	CNIArg string       `json:"cniArg,omitempty"`
+}
+
+// validate checks the values of the conditions
+func (c *RouteCondition) validate() error {
+	if c.IfName != "" {
+		if _, err := filepath.Match(c.IfName, ""); err != nil {
+			return fmt.Errorf("invalid ifname %q: %v", c.IfName, err)
+		}
+	}
+	if c.Family != 0 && c.Family != 4 && c.Family != 6 {
+		return fmt.Errorf("invalid family %d: must be 4 or 6", c.Family)
+	}
+	if c.CNIArg != "" && !strings.Contains(c.CNIArg, "=") {
+		return fmt.Errorf("invalid cniArg %q: must be KEY=VAL", c.CNIArg)
+	}
+	return nil
+}
+
+// whenContext is what conditions are evaluated against: the candidate
+// interface names, their addresses and the CNI_ARGS
+type whenContext struct {
+	ifNames []string
+	ips     []*current.IPConfig
+	args    *CNIArgs
+}
+
+// holds returns true if all conditions hold in the context
+func (c *RouteCondition) holds(ctx *whenContext) bool {
+	if c.IfName != "" {
+		found := false
+		for _, name := range ctx.ifNames {
+			if ok, _ := filepath.Match(c.IfName, name); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.IPIn != nil {
+		found := false
+		for _, ip := range ctx.ips {
+			if (*net.IPNet)(c.IPIn).Contains(ip.Address.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.Family != 0 {
+		found := false
+		for _, ip := range ctx.ips {
+			if (ip.Address.IP.To4() == nil) == (c.Family == 6) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.CNIArg != "" {
+		kv := strings.SplitN(c.CNIArg, "=", 2)
+		if value, ok := ctx.args.pairs[kv[0]]; !ok || value != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// routeWhenContext is the context of a route on the interface
+func routeWhenContext(res *current.Result, args *CNIArgs, ifName string) *whenContext {
+	return &whenContext{
+		ifNames: []string{ifName},
+		ips:     newRouteTemplateData(res, ifName).ips,
+		args:    args,
+	}
+}
+
+// profileWhenContext is the context of a profile: any interface and
+// address of the result
+func profileWhenContext(res *current.Result, args *CNIArgs) *whenContext {
+	ctx := &whenContext{args: args}
+	if res != nil {
+		ctx.ifNames = sandboxIfNames(res)
+		ctx.ips = res.IPs
+	}
+	return ctx
+}
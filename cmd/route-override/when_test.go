@@ -0,0 +1,142 @@
+// Copyright 2019 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// disable dot-imports only for testing
+//revive:disable:dot-imports
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("route-override conditions", func() {
+	prevResult := `"prevResult": {
+		"cniVersion": "0.3.1",
+		"interfaces": [
+			{ "name": "net0", "sandbox": "netns" },
+			{ "name": "net1", "sandbox": "netns" }
+		],
+		"ips": [
+			{ "version": "4", "address": "10.0.0.2/24", "gateway": "10.0.0.1", "interface": 0 },
+			{ "version": "4", "address": "10.1.0.2/24", "gateway": "10.1.0.1", "interface": 1 },
+			{ "version": "6", "address": "fd00:1::2/64", "interface": 1 }
+		]
+	}`
+	ifNames := []string{"net0", "net1"}
+
+	It("plans only the routes whose conditions hold", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": [
+				{ "dst": "192.168.1.0/24", "gw": "10.0.0.254", "when": { "ipIn": "10.0.0.0/16" } },
+				{ "dst": "192.168.2.0/24", "gw": "10.0.0.254", "when": { "ipIn": "10.20.0.0/16" } },
+				{ "dst": "fd00:2::/64", "gw": "fd00:1::1", "dev": "net1", "when": { "family": 6 } },
+				{ "dst": "fd00:3::/64", "gw": "fd00:1::1", "when": { "family": 6 } },
+				{ "dst": "192.168.3.0/24", "gw": "10.0.0.254", "when": { "cniArg": "SITE=a" } },
+				{ "dst": "192.168.4.0/24", "gw": "10.0.0.254", "when": { "cniArg": "SITE=b" } },
+				{ "dst": "192.168.5.0/24", "gw": "10.0.0.254", "when": { "ifname": "net1" } },
+				{ "dst": "192.168.6.0/24", "gw": "{{.Subnet4 | host 254}}", "when": { "ifname": "net*", "family": 4 } }
+			],
+			`+prevResult+`
+		}`), "IgnoreUnknown=1;SITE=a")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, ifNames, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"replace 192.168.1.0/24 via 10.0.0.254 dev net0",
+			"replace fd00:2::/64 via fd00:1::1 dev net1",
+			"replace 192.168.3.0/24 via 10.0.0.254 dev net0",
+			"replace 192.168.6.0/24 via 10.0.0.254 dev net0",
+		}))
+	})
+
+	It("leaves out steps whose route does not apply", func() {
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"operations": [
+				{ "op": "replace", "route": { "dst": "192.168.1.0/24", "gw": "10.0.0.254", "when": { "family": 6 } } },
+				{ "op": "replace", "route": { "dst": "192.168.2.0/24", "gw": "10.0.0.254", "when": { "family": 4 } } }
+			],
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+
+		plan, err := planRoutes(conf, ifNames, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(testPlanOperations(plan)).To(Equal([]string{
+			"replace 192.168.2.0/24 via 10.0.0.254 dev net0",
+		}))
+	})
+
+	It("selects profiles whose conditions hold", func() {
+		profiles := `"profiles": {
+			"site-b": { "when": { "ipIn": "10.1.0.0/16" }, "flushgateway": true },
+			"site-c": { "when": { "ipIn": "10.30.0.0/16" }, "flushroutes": true }
+		},`
+		conf, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			`+profiles+`
+			`+prevResult+`
+		}`), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.FlushGateway).To(BeTrue())
+		Expect(conf.FlushRoutes).To(BeFalse())
+
+		// a named profile is not used if its conditions do not hold
+		conf, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			`+profiles+`
+			`+prevResult+`
+		}`), "ROUTE_PROFILE=site-c")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.FlushGateway).To(BeFalse())
+		Expect(conf.FlushRoutes).To(BeFalse())
+	})
+
+	It("rejects invalid conditions", func() {
+		_, err := parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"addroutes": [{ "dst": "192.168.1.0/24", "when": { "family": 5 } }]
+		}`), "")
+		Expect(err).To(MatchError(ContainSubstring("invalid when: invalid family 5: must be 4 or 6")))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"profiles": { "bad": { "when": { "cniArg": "SITE" } } }
+		}`), "")
+		Expect(err).To(MatchError(`failed to load netconf: profile "bad": invalid when: invalid cniArg "SITE": must be KEY=VAL`))
+
+		_, err = parseConf([]byte(`{
+			"name": "test",
+			"type": "route-override",
+			"cniVersion": "0.3.1",
+			"operations": [{ "op": "flush", "match": { "dst": "10.0.0.0/8", "when": { "family": 4 } } }]
+		}`), "")
+		Expect(err).To(MatchError(ContainSubstring("when is only supported on routes")))
+	})
+})